@@ -0,0 +1,438 @@
+package iislog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/simulot/golib/pipeline"
+	"github.com/simulot/iislog/expr"
+	"github.com/simulot/iislog/iis"
+	"gopkg.in/yaml.v3"
+)
+
+// alertRules is the content of the rules file of the alert command, like:
+//
+//	webhook: http://alerts.example.com/hook
+//	rules:
+//	  - name: api-5xx
+//	    where: uri ~ "^/api/"
+//	    match: status >= 500
+//	    rate: 2%
+//	    over: 5m
+//	  - name: checkout-p95
+//	    where: uri == "/checkout"
+//	    percentile: 95
+//	    above: 3s
+//	    over: 5m
+//	  - name: unauthorized-ip
+//	    where: status == 401 && substatus == 1
+//	    by: c-ip
+//	    count: 50
+//	    over: 1m
+type alertRules struct {
+	Webhook string       `yaml:"webhook"` // URL where notifications are posted
+	Rules   []*alertRule `yaml:"rules"`
+}
+
+// alertRule is a threshold on the records of a sliding time window. The rule
+// fires when the count of records is above count, when the rate of records
+// matching match is above rate, or when the percentile of time-taken is above.
+type alertRule struct {
+	Name       string        `yaml:"name"`
+	Where      string        `yaml:"where"`      // Records taken into account, all when empty
+	By         string        `yaml:"by"`         // Field giving a window to each of its values
+	Over       time.Duration `yaml:"over"`       // Duration of the window
+	Count      *int          `yaml:"count"`      // Maximum count of records
+	Match      string        `yaml:"match"`      // Records counted by rate
+	Rate       string        `yaml:"rate"`       // Maximum rate of matching records, like 2%
+	Percentile float64       `yaml:"percentile"` // Percentile of time-taken, like 95
+	Above      time.Duration `yaml:"above"`      // Maximum percentile of time-taken
+	Min        int           `yaml:"min"`        // Minimum count of records to evaluate rate and percentile
+
+	where, match *expr.Expr
+	by           string  // W3C name of By
+	rate         float64 // Rate as a fraction
+	groups       map[string]*alertGroup
+}
+
+// alertEvent is a record in a window
+type alertEvent struct {
+	t         time.Time
+	matched   bool
+	timeTaken time.Duration
+}
+
+// alertGroup is the window of a rule for a value of the by field
+type alertGroup struct {
+	events    []alertEvent
+	matched   int       // Count of matched events
+	firing    bool      // The alert has been notified
+	since     time.Time // Time of the firing notification
+	evaluated time.Time // Last evaluation
+}
+
+// alertNotification is posted to the webhook when a rule fires, and when it's resolved
+type alertNotification struct {
+	Status    string     `json:"status"` // firing or resolved
+	Rule      string     `json:"rule"`
+	Group     string     `json:"group,omitempty"` // Value of the by field
+	Value     float64    `json:"value"`           // Count, rate, or percentile in seconds
+	Threshold float64    `json:"threshold"`
+	Count     int        `json:"count"` // Count of records in the window
+	StartsAt  time.Time  `json:"startsAt"`
+	EndsAt    *time.Time `json:"endsAt,omitempty"`
+	Summary   string     `json:"summary"`
+}
+
+// loadAlertRules reads and checks a rules file
+func loadAlertRules(file string) (*alertRules, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rules := &alertRules{}
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err = dec.Decode(rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	for i, r := range rules.Rules {
+		if err = r.compile(); err != nil {
+			name := r.Name
+			if name == "" {
+				name = "#" + strconv.Itoa(i+1)
+			}
+			return nil, fmt.Errorf("%s: rule %s: %w", file, name, err)
+		}
+	}
+	return rules, nil
+}
+
+// compile checks the rule, and prepares it for evaluation
+func (r *alertRule) compile() (err error) {
+	if r.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+	if r.Over <= 0 {
+		return fmt.Errorf("missing over duration")
+	}
+	thresholds := 0
+	if r.Count != nil {
+		thresholds++
+	}
+	if r.Rate != "" {
+		thresholds++
+		if r.Match == "" {
+			return fmt.Errorf("rate needs match")
+		}
+		rate := strings.TrimSuffix(r.Rate, "%")
+		if r.rate, err = strconv.ParseFloat(rate, 64); err != nil {
+			return fmt.Errorf("rate: %w", err)
+		}
+		if rate != r.Rate {
+			r.rate /= 100
+		}
+	}
+	if r.Percentile != 0 {
+		thresholds++
+		if r.Percentile <= 0 || r.Percentile > 100 {
+			return fmt.Errorf("percentile must be between 0 and 100")
+		}
+		if r.Above <= 0 {
+			return fmt.Errorf("percentile needs above")
+		}
+	}
+	if thresholds != 1 {
+		return fmt.Errorf("needs one of count, rate or percentile")
+	}
+	if r.Where != "" {
+		if r.where, err = expr.Compile(r.Where); err != nil {
+			return fmt.Errorf("where: %w", err)
+		}
+	}
+	if r.Match != "" {
+		if r.match, err = expr.Compile(r.Match); err != nil {
+			return fmt.Errorf("match: %w", err)
+		}
+	}
+	if r.By != "" {
+		r.by = columnField(r.By)
+	}
+	r.groups = map[string]*alertGroup{}
+	return nil
+}
+
+// evict removes events out of the window ending at now
+func (r *alertRule) evict(g *alertGroup, now time.Time) {
+	start := now.Add(-r.Over)
+	i := 0
+	for i < len(g.events) && !g.events[i].t.After(start) {
+		if g.events[i].matched {
+			g.matched--
+		}
+		i++
+	}
+	g.events = g.events[i:]
+}
+
+// value gives the value compared to the threshold, and the threshold.
+// ok is false when there are too few records.
+func (r *alertRule) value(g *alertGroup) (value, threshold float64, ok bool) {
+	n := len(g.events)
+	switch {
+	case r.Count != nil:
+		return float64(n), float64(*r.Count), true
+	case r.Rate != "":
+		if n == 0 {
+			return 0, r.rate, n >= r.Min
+		}
+		return float64(g.matched) / float64(n), r.rate, n >= r.Min
+	default:
+		if n == 0 {
+			return 0, r.Above.Seconds(), n >= r.Min
+		}
+		taken := make([]time.Duration, n)
+		for i, e := range g.events {
+			taken[i] = e.timeTaken
+		}
+		sort.Slice(taken, func(i, j int) bool { return taken[i] < taken[j] })
+		return taken[nearestRank(r.Percentile, n)].Seconds(), r.Above.Seconds(), n >= r.Min
+	}
+}
+
+// summary describes the state of the rule
+func (r *alertRule) summary(group string, value float64) string {
+	s := r.Name
+	if group != "" {
+		s += " [" + group + "]"
+	}
+	switch {
+	case r.Count != nil:
+		s += fmt.Sprintf(": %d records, threshold %d", int(value), *r.Count)
+	case r.Rate != "":
+		s += fmt.Sprintf(": %s matching records, threshold %s", strconv.FormatFloat(value*100, 'f', 2, 64)+"%", r.Rate)
+	default:
+		s += fmt.Sprintf(": p%s time-taken %v, threshold %v", strconv.FormatFloat(r.Percentile, 'f', -1, 64), time.Duration(value*float64(time.Second)).Round(time.Millisecond), r.Above)
+	}
+	return s + " over " + r.Over.String()
+}
+
+// alerter evaluates rules over a stream of records sorted by date, and notifies
+// when a rule fires or is resolved
+type alerter struct {
+	rules  []*alertRule
+	notify func(*alertNotification)
+	sweep  time.Time               // Last evaluation of all firing alerts
+	posts  chan *alertNotification // Notifications to post to the webhook, nil without webhook
+	posted chan struct{}           // Closed when notifications are posted
+}
+
+// close waits for notifications to be posted
+func (al *alerter) close() {
+	if al.posts != nil {
+		close(al.posts)
+		<-al.posted
+	}
+}
+
+// add takes a record into account
+func (al *alerter) add(rec *iis.LogRecord) {
+	now := rec.DateTime
+	for _, r := range al.rules {
+		if r.where != nil && !r.where.Match(rec) {
+			continue
+		}
+		group := ""
+		if r.by != "" {
+			group = fmt.Sprint(rec.Get(r.by))
+		}
+		g, ok := r.groups[group]
+		if !ok {
+			g = &alertGroup{}
+			r.groups[group] = g
+		}
+		e := alertEvent{t: now, timeTaken: rec.TimeTaken}
+		if r.match != nil && r.match.Match(rec) {
+			e.matched = true
+			g.matched++
+		}
+		g.events = append(g.events, e)
+		r.evict(g, now)
+		if r.Percentile == 0 || now.Sub(g.evaluated) >= time.Second {
+			// Percentiles are evaluated at most once a second
+			al.evaluate(r, group, g, now)
+		}
+	}
+	if now.Sub(al.sweep) >= time.Second {
+		al.advance(now)
+	}
+}
+
+// advance moves windows up to now, so alerts are resolved when records stop coming
+func (al *alerter) advance(now time.Time) {
+	al.sweep = now
+	for _, r := range al.rules {
+		for group, g := range r.groups {
+			r.evict(g, now)
+			if g.firing {
+				al.evaluate(r, group, g, now)
+			}
+			if len(g.events) == 0 && !g.firing {
+				delete(r.groups, group)
+			}
+		}
+	}
+}
+
+// tick moves windows with the clock minus the lag of logs, unless records are more recent
+func (al *alerter) tick(now time.Time, lag time.Duration) {
+	if now = now.Add(-lag); now.After(al.sweep) {
+		al.advance(now)
+	}
+}
+
+// evaluate checks the threshold of a rule, and notifies changes
+func (al *alerter) evaluate(r *alertRule, group string, g *alertGroup, now time.Time) {
+	g.evaluated = now
+	value, threshold, ok := r.value(g)
+	firing := ok && value > threshold
+	if firing == g.firing {
+		// Already notified
+		return
+	}
+	g.firing = firing
+	n := &alertNotification{
+		Status:    "firing",
+		Rule:      r.Name,
+		Group:     group,
+		Value:     value,
+		Threshold: threshold,
+		Count:     len(g.events),
+		StartsAt:  now,
+		Summary:   r.summary(group, value),
+	}
+	if firing {
+		g.since = now
+	} else {
+		n.Status = "resolved"
+		n.StartsAt = g.since
+		n.EndsAt = &now
+	}
+	al.notify(n)
+}
+
+// alertClient posts notifications to the webhook
+var alertClient = &http.Client{Timeout: 10 * time.Second}
+
+// postAlert posts a notification to the webhook, trying again after a failure, until ctx is done
+func postAlert(ctx context.Context, webhook string, n *alertNotification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		var (
+			req  *http.Request
+			resp *http.Response
+		)
+		if req, err = http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(body)); err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err = alertClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return nil
+			}
+			err = fmt.Errorf("webhook %s: %s", webhook, resp.Status)
+		}
+		if attempt == 2 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Duration(attempt+1) * time.Second):
+		}
+	}
+}
+
+// alertQueue is the number of notifications waiting to be posted before evaluation waits
+const alertQueue = 100
+
+// newAlerter loads the rules file. Notifications are written on the output, and posted
+// to the webhook if any, in the background so evaluation goes on while the webhook is slow.
+func (a *Application) newAlerter() (*alerter, error) {
+	rules, err := loadAlertRules(a.rulesFile)
+	if err != nil {
+		return nil, err
+	}
+	webhook := rules.Webhook
+	if a.webhook != "" {
+		webhook = a.webhook
+	}
+	al := &alerter{rules: rules.Rules}
+	if webhook != "" {
+		al.posts = make(chan *alertNotification, alertQueue)
+		al.posted = make(chan struct{})
+		ctx := a.context()
+		go func() {
+			defer close(al.posted)
+			for n := range al.posts {
+				if err := postAlert(ctx, webhook, n); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+				}
+			}
+		}()
+	}
+	enc := json.NewEncoder(a.out)
+	enc.SetEscapeHTML(false)
+	al.notify = func(n *alertNotification) {
+		enc.Encode(n)
+		if al.posts != nil {
+			al.posts <- n
+		}
+	}
+	return al, nil
+}
+
+// AlertOperator creates an operator that evaluates alert rules over records.
+// When logs are followed, windows move with the clock minus the --lag of IIS
+// writing lines, so alerts are resolved even when no more records come, and
+// aren't resolved before late lines are read.
+func (a *Application) AlertOperator(al *alerter) pipeline.Operator {
+	return func(in, out chan interface{}) {
+		defer al.close()
+		var tick <-chan time.Time
+		if a.follow {
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case i, ok := <-in:
+				if !ok {
+					return
+				}
+				item, ok := i.(*iis.LogRecord)
+				if !ok {
+					panic("Expecting *iis.LogRecord in pipeline.Operator AlertOperator")
+				}
+				al.add(item)
+			case now := <-tick:
+				al.tick(now.UTC(), a.lag)
+			}
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package iislog
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/simulot/iislog/iis"
+)
+
+func TestAlert(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		received []alertNotification
+	)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := alertNotification{}
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		received = append(received, n)
+		mu.Unlock()
+	}))
+	defer hook.Close()
+
+	dir := t.TempDir()
+	rules := filepath.Join(dir, "rules.yaml")
+	os.WriteFile(rules, []byte(`
+webhook: `+hook.URL+`
+rules:
+  - name: unauthorized
+    where: status == 401
+    by: c-ip
+    count: 2
+    over: 1m
+  - name: errors
+    where: uri == "/b"
+    match: status >= 500
+    rate: 50%
+    over: 1m
+    min: 2
+`), 0644)
+
+	log := "#Date: 2017-01-31 09:00:00\r\n" +
+		"#Fields: date time c-ip cs-uri-stem sc-status\r\n" +
+		"2017-01-31 09:00:00 10.0.0.1 /a 401\r\n" +
+		"2017-01-31 09:00:10 10.0.0.1 /a 401\r\n" +
+		"2017-01-31 09:00:20 10.0.0.2 /a 401\r\n" +
+		"2017-01-31 09:00:30 10.0.0.1 /a 401\r\n" + // Fires unauthorized [10.0.0.1]
+		"2017-01-31 09:00:40 10.0.0.1 /a 401\r\n" + // Still firing, not notified again
+		"2017-01-31 09:00:50 10.0.0.3 /b 500\r\n" +
+		"2017-01-31 09:00:55 10.0.0.3 /b 500\r\n" + // Fires errors
+		"2017-01-31 09:02:00 10.0.0.3 /b 200\r\n" // Resolves both
+
+	a := NewApplication()
+	a.rulesFile = rules
+	out := strings.Builder{}
+	a.out = &out
+	al, err := a.newAlerter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for r := range iis.NewLogParser(strings.NewReader(log)).Records(nil) {
+		al.add(r)
+	}
+	al.close()
+
+	expected := []string{
+		"firing unauthorized 10.0.0.1 3",
+		"firing errors  1",
+		"resolved errors  0",
+		"resolved unauthorized 10.0.0.1 0",
+	}
+	got := []string{}
+	for _, n := range received {
+		got = append(got, strings.Join([]string{n.Status, n.Rule, n.Group, formatFloat(n.Value)}, " "))
+		if n.Status == "resolved" && (n.EndsAt == nil || !n.EndsAt.After(n.StartsAt)) {
+			t.Errorf("%s: expecting endsAt after startsAt", n.Summary)
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expecting notifications:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+	if lines := strings.Count(out.String(), "\n"); lines != len(expected) {
+		t.Errorf("Expecting %d notifications on the output, got %d", len(expected), lines)
+	}
+}
+
+func TestAlertLag(t *testing.T) {
+	dir := t.TempDir()
+	rules := filepath.Join(dir, "rules.yaml")
+	os.WriteFile(rules, []byte("rules:\n  - name: requests\n    count: 1\n    over: 1m\n"), 0644)
+	a := NewApplication()
+	a.rulesFile = rules
+	out := strings.Builder{}
+	a.out = &out
+	al, err := a.newAlerter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Lines written 30s ago by IIS, read now
+	now := time.Date(2017, 1, 31, 9, 0, 0, 0, time.UTC)
+	for _, r := range []*iis.LogRecord{{DateTime: now.Add(-30 * time.Second)}, {DateTime: now.Add(-29 * time.Second)}} {
+		al.add(r)
+	}
+	al.tick(now.Add(40*time.Second), time.Minute)
+	if n := strings.Count(out.String(), "\n"); n != 1 {
+		t.Errorf("Expecting the alert to be firing during the lag, got %d notifications:\n%s", n, out.String())
+	}
+	al.tick(now.Add(2*time.Minute), time.Minute)
+	if !strings.Contains(out.String(), `"status":"resolved"`) {
+		t.Errorf("Expecting the alert to be resolved after the lag, got:\n%s", out.String())
+	}
+}
+
+func TestAlertWebhookStopped(t *testing.T) {
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer hook.Close()
+	dir := t.TempDir()
+	rules := filepath.Join(dir, "rules.yaml")
+	os.WriteFile(rules, []byte("rules:\n  - name: requests\n    count: 0\n    over: 1m\n"), 0644)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a := NewApplication()
+	a.rulesFile = rules
+	a.webhook = hook.URL
+	a.out = &strings.Builder{}
+	a.ctx = ctx
+	al, err := a.newAlerter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Evaluation doesn't wait for the webhook, which stops being tried when the context is done
+	start := time.Now()
+	al.add(&iis.LogRecord{DateTime: start})
+	cancel()
+	al.close()
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("Expecting posts to stop with the context, took %v", d)
+	}
+}
+
+func TestAlertRules(t *testing.T) {
+	tests := map[string]string{
+		"rules:\n  - over: 1m\n    count: 1\n":                          "rule #1: missing name",
+		"rules:\n  - name: a\n    count: 1\n":                           "rule a: missing over duration",
+		"rules:\n  - name: a\n    over: 1m\n":                           "rule a: needs one of count, rate or percentile",
+		"rules:\n  - name: a\n    over: 1m\n    rate: 2%\n":             "rule a: rate needs match",
+		"rules:\n  - name: a\n    over: 1m\n    percentile: 95\n":       "rule a: percentile needs above",
+		"rules:\n  - name: a\n    over: 1m\n    count: 1\n    where: x": "rule a: where:",
+		"rules:\n  - name: a\n    over: 1m\n    limit: 1\n":             "field limit not found",
+	}
+	dir := t.TempDir()
+	for content, expected := range tests {
+		file := filepath.Join(dir, "rules.yaml")
+		os.WriteFile(file, []byte(content), 0644)
+		if _, err := loadAlertRules(file); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%q: expecting error %q, got %v", content, expected, err)
+		}
+	}
+}
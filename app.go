@@ -1,6 +1,10 @@
 package iislog
 
 import (
+	"context"
+	"io"
+	"os"
+	"os/signal"
 	"time"
 
 	_ "github.com/simulot/golib/file/walker/zipwalker" //register zip walker
@@ -9,53 +13,211 @@ import (
 
 // Application represents the application state and its parameters
 type Application struct {
-	files            []string      // Files, paths, archives to be explored
-	dateFrom, dateTo time.Time     // Set exploration time limits
-	protocolError    bool          // indicates to filter 4xx and 5xx errors
-	hideAssets       bool          // indicate to filer gif, png, css, js
-	longQueries      time.Duration // search queries longer than this
-	urls             []string      // URL to be reported. Cumulative.
-	users            []string      // List of user concerned. Cumulative
+	Query                      // What is searched
+	command    string          // Command given on the command line
+	groupBy    []string        // Fields used to group statistics
+	format     string          // Output format: csv, jsonl, store, sqlite, elasticsearch, loki or splunk
+	columns    []string        // Output columns
+	delimiter  rune            // CSV fields delimiter
+	noHeader   bool            // Don't write the header line
+	decode     bool            // Percent-decode URIs and queries in output
+	output     string          // Output file, console when empty, or server URL of sink formats
+	esIndex    string          // Prefix of Elasticsearch index names
+	checkpoint string          // File of the last lines sent by sinks
+	token      string          // Token of the Splunk HTTP Event Collector
+	rejects    string          // File where lines that can't be parsed are written
+	verbose    bool            // Report files skipped because they aren't IIS logs
+	sqlQuery   string          // Query of the sql command
+	limit      int             // Count of records after which the search stops, 0 for all
+	listen     string          // Address of the HTTP server of serve and metrics commands
+	rulesFile  string          // Rules of the alert command
+	webhook    string          // URL where alerts are posted
+	follow     bool            // Follow log folders instead of reading files
+	lag        time.Duration   // Delay of IIS writing lines, when alerts follow log folders
+	errs       *parseErrors    // Errors met while reading logs
+	indexes    *indexCache     // Index files, nil when they are ignored
+	out        io.Writer       // Where results are written
+	ctx        context.Context // Stops the pipeline when done
 }
 
-// Run runs the application
-func (a *Application) Run() {
+// Commands
+const (
+	searchCommand   = "search"
+	statsCommand    = "stats"
+	tailCommand     = "tail"
+	convertCommand  = "convert"
+	describeCommand = "describe"
+	mergeCommand    = "merge"
+	indexCommand    = "index"
+	sqlCommand      = "sql"
+	serveCommand    = "serve"
+	metricsCommand  = "metrics"
+	alertCommand    = "alert"
+)
+
+// Run runs the application on files given on the command line
+func (a *Application) Run() error {
+	if a.command == serveCommand {
+		return a.serve()
+	}
+	return a.run(a.sources())
+}
+
+// run runs the application on sources: paths, or logItem.
+// On Ctrl-C, the pipeline stops and records already sorted are written.
+// A summary of errors met while reading logs is written at the end. In strict
+// mode, the application stops at the first error, and returns it.
+func (a *Application) run(sources []interface{}) error {
+	interrupted, stop := signal.NotifyContext(a.context(), os.Interrupt)
+	defer stop()
+	go func() {
+		// A second Ctrl-C kills the application
+		<-interrupted.Done()
+		stop()
+	}()
+	a.ctx = interrupted
+	return a.runContext(sources, os.Stderr)
+}
+
+// runContext runs the command on sources until the context of the application
+// is done, and writes the summary of parse errors on errOut
+func (a *Application) runContext(sources []interface{}, errOut io.Writer) error {
+	ctx, cancel := context.WithCancel(a.context())
+	defer cancel()
+	a.ctx = ctx
+
+	if a.out == nil {
+		a.out = os.Stdout
+	}
+	if a.output != "" && !a.ownOutput() {
+		f, err := os.Create(a.output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		a.out = f
+	}
+	var rejects io.Writer
+	if a.rejects != "" {
+		f, err := os.Create(a.rejects)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		rejects = f
+	}
+	a.errs = newParseErrors(a.strict, cancel, rejects)
+	if !a.noIndex {
+		a.indexes = newIndexCache()
+	}
+
 	in := make(chan interface{})
 	go func() {
-		for _, file := range a.files {
-			in <- file // Injects CLI arguments into the pipeline
+		for _, source := range sources {
+			in <- source // Injects sources into the pipeline
 		}
 		close(in) // We are done
 	}()
 
-	pipe := pipeline.NewFlow(
-		// Expands arguments having wild cards into flow of path
-		pipeline.GlobOperator(),
+	var pipe *pipeline.Flow
+	switch a.command {
+	case tailCommand:
+		// Follows log folders and outputs new records
+		pipe = pipeline.NewFlow(a.FollowOperator(), a.OutputOperator())
+	case metricsCommand:
+		// Follows log folders and serves metrics of new records
+		m := newMetrics(a.errs)
+		if err := a.serveMetrics(m); err != nil {
+			return err
+		}
+		pipe = pipeline.NewFlow(a.FollowOperator(), a.MetricsOperator(m))
+	case alertCommand:
+		// Evaluates alert rules over records, as they are written when following folders
+		al, err := a.newAlerter()
+		if err != nil {
+			return err
+		}
+		if a.follow {
+			pipe = pipeline.NewFlow(a.FollowOperator(), a.AlertOperator(al))
+		} else {
+			pipe = a.parseFlow(a.MergeOperator(), a.AlertOperator(al))
+		}
+	case describeCommand:
+		// Describes each file
+		pipe = a.parseFlow(a.DescribeOperator())
+	case statsCommand:
+		pipe = a.parseFlow(a.MergeOperator(), a.StatsOperator())
+	case mergeCommand:
+		pipe = a.parseFlow(a.MergeOperator(), a.W3COutputOperator())
+	case sqlCommand:
+		// Runs the query on matching records
+		pipe = a.parseFlow(a.MergeOperator(), a.SQLOperator())
+	case indexCommand:
+		// Writes the index of log files
+		pipe = a.indexFlow()
+	default:
+		tail := []pipeline.Operator{a.MergeOperator()}
+		if a.limit > 0 {
+			tail = append(tail, a.limitOperator(cancel))
+		}
+		pipe = a.parseFlow(append(tail, a.OutputOperator())...)
+	}
+	<-pipe.Run(in)
+
+	if err := a.errs.close(errOut); err != nil {
+		return err
+	}
+	if err := a.errs.failed(); err != nil {
+		return err
+	}
+	if a.strict {
+		return a.errs.first()
+	}
+	return nil
+}
+
+// context gives the context of the application, that stops the pipeline when done
+func (a *Application) context() context.Context {
+	if a.ctx == nil {
+		return context.Background()
+	}
+	return a.ctx
+}
 
-		// Takes a path (file, folder, archive) and makes a walker on it
-		pipeline.FolderToWalkersOperator(),
+// parseFlow makes the pipeline that finds log files and makes streams of records,
+// followed by operators specific to the command
+func (a *Application) parseFlow(tail ...pipeline.Operator) *pipeline.Flow {
+	return pipeline.NewFlow(append([]pipeline.Operator{
+		// Finds files in paths given as arguments
+		pathsOperator(),
 
 		pipeline.NewParallelFlow(
 			8,
 
-			// Walks through the walker and makes a flow of items (folder files, archive items)
-			pipeline.WalkOperator(),
+			// Opens compressed files and archives, and emits the files they contain
+			a.ArchiveOperator(),
 
-			// Excludes everything but IIS log files
-			pipeline.FileMaskOperator("u_ex*.log"),
-
-			// Excludes files which date is outside time frame
+			// Excludes files which aren't IIS logs, or which date is outside time frame
 			a.FileFilterOperator(),
 
-			// Parses log file and emits a flow of log records
+			// Makes a stream of log records for each file
 			a.ParserOperator(),
 		),
+	}, tail...)...)
+}
 
-		// Remove multiples occurrences of an entry
-		a.DeduplicateOperator(),
+// indexFlow makes the pipeline that finds log files and writes their index
+func (a *Application) indexFlow() *pipeline.Flow {
+	return pipeline.NewFlow(
+		pathsOperator(),
+		pipeline.NewParallelFlow(
+			8,
+			a.ArchiveOperator(),
+			a.FileFilterOperator(),
 
-		// Outputs log records
-		a.OutputOperator(),
+			// Reads each file and makes its index
+			a.IndexOperator(),
+		),
+		a.IndexWriterOperator(),
 	)
-	<-pipe.Run(in)
 }
@@ -0,0 +1,84 @@
+package iislog
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestRunCommands(t *testing.T) {
+	tests := []struct {
+		command  string
+		format   string
+		columns  []string
+		groupBy  []string
+		logs     []string
+		expected string
+	}{
+		{
+			command: searchCommand, columns: []string{"datetime", "cs-uri-stem", "sc-status"}, logs: []string{sourceLog1, sourceLog2},
+			expected: "datetime;cs-uri-stem;sc-status\r\n" +
+				"2017-01-31 09:08:40;/a;200\r\n" +
+				"2017-01-31 09:09:00;/b;404\r\n" +
+				"2017-01-31 09:10:00;/c;500\r\n",
+		},
+		{
+			command: statsCommand, groupBy: []string{"sc-status"}, logs: []string{sourceLog1, sourceLog2},
+			expected: "sc-status;count;time-taken-sum(ms);time-taken-avg(ms);time-taken-min(ms);time-taken-max(ms);time-taken-p50(ms);time-taken-p95(ms);time-taken-p99(ms);" +
+				"sc-bytes-sum;sc-bytes-avg;sc-bytes-min;sc-bytes-max;sc-bytes-p50;sc-bytes-p95;sc-bytes-p99\r\n" +
+				"200;1;0;0;0;0;0;0;0;0;0;0;0;0;0;0\r\n" +
+				"404;1;0;0;0;0;0;0;0;0;0;0;0;0;0;0\r\n" +
+				"500;1;0;0;0;0;0;0;0;0;0;0;0;0;0;0\r\n",
+		},
+		{
+			// Streams are read until their end, in the order of lines
+			command: tailCommand, columns: []string{"cs-uri-stem", "status"}, logs: []string{sourceLog1},
+			expected: "cs-uri-stem;status\r\n" +
+				"/a;200.0\r\n" +
+				"/c;500.0\r\n",
+		},
+		{
+			command: convertCommand, format: "jsonl", logs: []string{sourceLog1, sourceLog2},
+			expected: `{"datetime":"2017-01-31T09:08:40Z","cs-uri-stem":"/a","sc-status":200,"status-label":"OK. The client request has succeeded"}` + "\n" +
+				`{"datetime":"2017-01-31T09:09:00Z","cs-uri-stem":"/b","sc-status":404,"status-label":"Not found"}` + "\n" +
+				`{"datetime":"2017-01-31T09:10:00Z","cs-uri-stem":"/c","sc-status":500,"status-label":"Module or ISAPI error occurred"}` + "\n",
+		},
+		{
+			command: describeCommand, logs: []string{sourceLog1, sourceLog2},
+			expected: "file;from;to;lines;servers;fields\r\n" +
+				"server1.log;2017-01-31 09:08:40;2017-01-31 09:10:00;2;;date time cs-uri-stem sc-status\r\n" +
+				"server2.log;2017-01-31 09:09:00;2017-01-31 09:09:00;1;;date time cs-uri-stem sc-status\r\n",
+		},
+		{
+			command: mergeCommand, logs: []string{sourceLog1, sourceLog2},
+			expected: "#Software: iislog\r\n#Version: 1.0\r\n#Date: 2017-01-31 09:08:40\r\n#Fields: date time cs-uri-stem sc-status\r\n" +
+				"2017-01-31 09:08:40 /a 200\r\n" +
+				"2017-01-31 09:09:00 /b 404\r\n" +
+				"2017-01-31 09:10:00 /c 500\r\n",
+		},
+	}
+	for _, tt := range tests {
+		a := NewApplication()
+		a.command = tt.command
+		if tt.format != "" {
+			a.format = tt.format
+		}
+		a.columns = tt.columns
+		a.groupBy = tt.groupBy
+		a.strict = true
+		b := bytes.NewBuffer(nil)
+		a.SetOutput(b)
+		readers := []NamedReader{}
+		for i, log := range tt.logs {
+			readers = append(readers, NamedReader{Name: fmt.Sprintf("server%d.log", i+1), Reader: strings.NewReader(log)})
+		}
+		if err := a.RunReaders(readers...); err != nil {
+			t.Errorf("%s: %v", tt.command, err)
+			continue
+		}
+		if b.String() != tt.expected {
+			t.Errorf("%s: expecting\n%s\ngot\n%s", tt.command, tt.expected, b.String())
+		}
+	}
+}
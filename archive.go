@@ -0,0 +1,369 @@
+package iislog
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/simulot/golib/file/walker"
+	"github.com/simulot/golib/pipeline"
+	"github.com/ulikunitz/xz"
+)
+
+// logItem is a file found in a folder or an archive
+type logItem interface {
+	Name() string
+	Reader() (io.Reader, error)
+	Close() error
+	Source() (file, member string) // Where the file comes from: a file, and the path of the file in archives
+}
+
+// walkerItem adapts items given by golib's walkers
+type walkerItem struct {
+	walker.WalkItem
+	root  string // Path given to the walker
+	isDir bool   // The root is a folder
+}
+
+func (w walkerItem) Close() error {
+	w.WalkItem.Close()
+	return nil
+}
+
+func (w walkerItem) Source() (file, member string) {
+	switch {
+	case w.root == "":
+		return w.Name(), ""
+	case w.isDir:
+		if f, ok := w.WalkItem.(interface{ FullName() string }); ok {
+			// Path of files in sub folders
+			return f.FullName(), ""
+		}
+		return filepath.Join(w.root, w.Name()), ""
+	case filepath.Base(w.root) == w.Name():
+		return w.root, ""
+	}
+	// File of an archive
+	return w.root, w.Name()
+}
+
+// memberOf gives the source of a file named name in the archive item
+func memberOf(item logItem, name string) (file, member string) {
+	file, member = item.Source()
+	if member != "" {
+		return file, member + "/" + name
+	}
+	return file, name
+}
+
+// ArchiveOperator creates an operator that opens compressed files (.gz, .bz2, .xz, .zst)
+// and archives (.tar, .tar.gz, .tgz... and .zip found in other archives),
+// and emits the files they contain
+func (a *Application) ArchiveOperator() pipeline.Operator {
+	return func(in, out chan interface{}) {
+		for i := range in {
+			switch item := i.(type) {
+			case logItem:
+				expand(item, out, a.errs, a.inDateRange)
+			case walker.WalkItem:
+				expand(walkerItem{WalkItem: item}, out, a.errs, a.inDateRange)
+			default:
+				panic("Expecting walker.WalkItem or logItem in pipeline.Operator ArchiveOperator")
+			}
+		}
+	}
+}
+
+// compression extensions, and extensions of compressed tar archives
+var compressions = map[string]string{
+	".gz":   "",
+	".bz2":  "",
+	".xz":   "",
+	".zst":  "",
+	".tgz":  ".tar",
+	".tbz2": ".tar",
+	".txz":  ".tar",
+	".tzst": ".tar",
+}
+
+// expand emits the item, or the files it contains when it's compressed or an archive.
+// Errors are reported to errs. Files of tar archives are copied only when keep is
+// nil or returns true for their name.
+func expand(item logItem, out chan interface{}, errs *parseErrors, keep func(name string) bool) {
+	name := strings.ToLower(item.Name())
+	ext := path.Ext(name)
+	if replace, ok := compressions[ext]; ok {
+		expand(&decompressedItem{item: item, name: strings.TrimSuffix(item.Name(), item.Name()[len(name)-len(ext):]) + replace, ext: ext}, out, errs, keep)
+		return
+	}
+	switch ext {
+	case ".tar":
+		expandTar(item, out, errs, keep)
+	case ".zip":
+		expandZip(item, out, errs, keep)
+	default:
+		out <- item
+	}
+}
+
+// inDateRange tells if a file may have records of the searched date range, according to
+// the date in its name, without its compression extensions
+func (a *Application) inDateRange(name string) bool {
+	for {
+		ext := strings.ToLower(path.Ext(name))
+		if replace, ok := compressions[ext]; !ok || replace != "" {
+			break
+		}
+		name = strings.TrimSuffix(name, name[len(name)-len(ext):])
+	}
+	from, to, ok := fileFrame(name)
+	return !ok || (!from.After(a.dateTo) && to.After(a.dateFrom))
+}
+
+// isInteresting returns true for names of files that may contain logs
+func isInteresting(name string) bool {
+	name = strings.ToLower(name)
+	ext := path.Ext(name)
+	if _, ok := compressions[ext]; ok {
+		return true
+	}
+	return ext == ".log" || ext == ".tar" || ext == ".zip" || ext == storeExt
+}
+
+// decompress returns a reader decompressing r according to the file extension
+func decompress(ext string, r io.Reader) (io.ReadCloser, error) {
+	switch ext {
+	case ".gz", ".tgz":
+		return gzip.NewReader(r)
+	case ".bz2", ".tbz2":
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	case ".xz", ".txz":
+		x, err := xz.NewReader(r)
+		return ioutil.NopCloser(x), err
+	case ".zst", ".tzst":
+		z, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return z.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unknown compression %s", ext)
+}
+
+// decompressedItem is the content of a compressed file
+type decompressedItem struct {
+	item logItem
+	name string // name without compression extension
+	ext  string
+	r    io.ReadCloser
+}
+
+func (d *decompressedItem) Name() string { return d.name }
+
+func (d *decompressedItem) Source() (file, member string) { return d.item.Source() }
+
+func (d *decompressedItem) Reader() (io.Reader, error) {
+	r, err := d.item.Reader()
+	if err != nil {
+		return nil, err
+	}
+	d.r, err = decompress(d.ext, r)
+	return d.r, err
+}
+
+func (d *decompressedItem) Close() error {
+	if d.r != nil {
+		d.r.Close()
+	}
+	return d.item.Close()
+}
+
+// expandTar emits files of a tar archive. As a tar can only be read sequentially,
+// and files are parsed later, interesting files are copied into temporary files,
+// unless the date in their name is out of the searched range.
+func expandTar(item logItem, out chan interface{}, errs *parseErrors, keep func(name string) bool) {
+	defer item.Close()
+	r, err := item.Reader()
+	if err != nil {
+		errs.report(item, err)
+		return
+	}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			errs.report(item, err)
+			return
+		}
+		if h.Typeflag != tar.TypeReg || !isInteresting(h.Name) || (keep != nil && !keep(path.Base(h.Name))) {
+			continue
+		}
+		spooled, err := spool(path.Base(h.Name), tr)
+		if spooled != nil {
+			spooled.file, spooled.member = memberOf(item, h.Name)
+		}
+		if err != nil {
+			errs.report(item, err)
+			return
+		}
+		expand(spooled, out, errs, keep)
+	}
+}
+
+// expandZip emits files of a zip archive found in another archive
+func expandZip(item logItem, out chan interface{}, errs *parseErrors, keep func(name string) bool) {
+	r, err := item.Reader()
+	if err != nil {
+		item.Close()
+		errs.report(item, err)
+		return
+	}
+	f, ok := r.(zipFile)
+	if !ok {
+		// zip needs random access, copy the archive into a temporary file
+		spooled, err := spool(item.Name(), r)
+		if spooled != nil {
+			spooled.file, spooled.member = item.Source()
+		}
+		item.Close()
+		if err != nil {
+			errs.report(item, err)
+			return
+		}
+		item = spooled
+		if r, err = item.Reader(); err != nil {
+			item.Close()
+			errs.report(item, err)
+			return
+		}
+		f = r.(zipFile)
+	}
+	info, err := f.Stat()
+	if err == nil {
+		var zr *zip.Reader
+		if zr, err = zip.NewReader(f, info.Size()); err == nil {
+			// The archive is closed when all its files are closed
+			archive := &sharedCloser{closer: item}
+			for _, zf := range zr.File {
+				if zf.FileInfo().IsDir() || !isInteresting(zf.Name) {
+					continue
+				}
+				archive.add()
+				z := &zipItem{file: zf, archive: archive}
+				z.source, z.member = memberOf(item, zf.Name)
+				expand(z, out, errs, keep)
+			}
+			archive.add()
+			archive.Close()
+			return
+		}
+	}
+	item.Close()
+	errs.report(item, err)
+}
+
+// zipFile is a file giving random access, as needed by zip
+type zipFile interface {
+	io.ReaderAt
+	Stat() (fs.FileInfo, error)
+}
+
+// zipItem is a file of a zip archive
+type zipItem struct {
+	file           *zip.File
+	archive        *sharedCloser
+	r              io.ReadCloser
+	source, member string
+}
+
+func (z *zipItem) Name() string { return path.Base(z.file.Name) }
+
+func (z *zipItem) Source() (file, member string) { return z.source, z.member }
+
+func (z *zipItem) Reader() (r io.Reader, err error) {
+	z.r, err = z.file.Open()
+	return z.r, err
+}
+
+func (z *zipItem) Close() error {
+	if z.r != nil {
+		z.r.Close()
+	}
+	return z.archive.Close()
+}
+
+// sharedCloser closes an archive when all its users have closed it
+type sharedCloser struct {
+	sync.Mutex
+	closer io.Closer
+	count  int
+}
+
+func (s *sharedCloser) add() {
+	s.Lock()
+	s.count++
+	s.Unlock()
+}
+
+func (s *sharedCloser) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	s.count--
+	if s.count == 0 {
+		return s.closer.Close()
+	}
+	return nil
+}
+
+// spooledItem is a file copied into a temporary file, removed when closed
+type spooledItem struct {
+	name         string
+	path         string
+	f            *os.File
+	file, member string // Source of the copied file
+}
+
+// spool copies the content of r into a temporary file
+func spool(name string, r io.Reader) (*spooledItem, error) {
+	f, err := ioutil.TempFile("", "iislog-")
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(f, r)
+	f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &spooledItem{name: name, path: f.Name()}, nil
+}
+
+func (s *spooledItem) Name() string { return s.name }
+
+func (s *spooledItem) Source() (file, member string) { return s.file, s.member }
+
+func (s *spooledItem) Reader() (r io.Reader, err error) {
+	s.f, err = os.Open(s.path)
+	return s.f, err
+}
+
+func (s *spooledItem) Close() error {
+	if s.f != nil {
+		s.f.Close()
+	}
+	return os.Remove(s.path)
+}
@@ -0,0 +1,115 @@
+package iislog
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memItem is a logItem in memory
+type memItem struct {
+	name string
+	data []byte
+}
+
+func (m *memItem) Name() string               { return m.name }
+func (m *memItem) Reader() (io.Reader, error) { return bytes.NewReader(m.data), nil }
+func (m *memItem) Close() error               { return nil }
+func (m *memItem) Source() (string, string)   { return m.name, "" }
+
+func gzipped(data []byte) []byte {
+	b := bytes.NewBuffer(nil)
+	w := gzip.NewWriter(b)
+	w.Write(data)
+	w.Close()
+	return b.Bytes()
+}
+
+func tarred(files map[string][]byte) []byte {
+	b := bytes.NewBuffer(nil)
+	w := tar.NewWriter(b)
+	for name, data := range files {
+		w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg})
+		w.Write(data)
+	}
+	w.Close()
+	return b.Bytes()
+}
+
+func zipped(files map[string][]byte) []byte {
+	b := bytes.NewBuffer(nil)
+	w := zip.NewWriter(b)
+	for name, data := range files {
+		f, _ := w.Create(name)
+		f.Write(data)
+	}
+	w.Close()
+	return b.Bytes()
+}
+
+func TestExpand(t *testing.T) {
+	// A tar.gz with a compressed log, a plain log, a zip with a log and a file to ignore
+	archive := gzipped(tarred(map[string][]byte{
+		"W3SVC1/u_ex170129.log.gz": gzipped([]byte("log 29")),
+		"W3SVC1/u_ex170130.log":    []byte("log 30"),
+		"W3SVC2/logs.zip":          zipped(map[string][]byte{"W3SVC2/u_ex170131.log": []byte("log 31")}),
+		"readme.txt":               []byte("not a log"),
+	}))
+
+	out := make(chan interface{}, 10)
+	expand(&memItem{name: "logs.tar.gz", data: archive}, out, nil, nil)
+	close(out)
+
+	got := []string{}
+	for i := range out {
+		item := i.(logItem)
+		r, err := item.Reader()
+		if err != nil {
+			t.Fatalf("Can't read %s: %v", item.Name(), err)
+		}
+		b, _ := ioutil.ReadAll(r)
+		got = append(got, item.Name()+":"+string(b))
+		if err = item.Close(); err != nil {
+			t.Errorf("Can't close %s: %v", item.Name(), err)
+		}
+	}
+	sort.Strings(got)
+	expected := "u_ex170129.log:log 29,u_ex170130.log:log 30,u_ex170131.log:log 31"
+	if strings.Join(got, ",") != expected {
+		t.Errorf("Expecting %s, got %s", expected, strings.Join(got, ","))
+	}
+}
+
+func TestExpandTarDates(t *testing.T) {
+	archive := tarred(map[string][]byte{
+		"u_ex170129.log.gz":  gzipped([]byte("log 29")),
+		"u_ex17013009.log":   []byte("log 30"),
+		"u_ex170131.log.bz2": []byte("log 31"),
+		"u_extend1.log":      []byte("no date"),
+	})
+	a := NewApplication()
+	a.dateFrom = time.Date(2017, 1, 30, 0, 0, 0, 0, time.UTC)
+	a.dateTo = time.Date(2017, 1, 30, 23, 59, 59, 0, time.UTC)
+
+	// Files out of the date range aren't copied
+	out := make(chan interface{}, 10)
+	expand(&memItem{name: "logs.tar", data: archive}, out, nil, a.inDateRange)
+	close(out)
+	got := []string{}
+	for i := range out {
+		item := i.(logItem)
+		got = append(got, item.Name())
+		item.Close()
+	}
+	sort.Strings(got)
+	if expected := "u_ex17013009.log,u_extend1.log"; strings.Join(got, ",") != expected {
+		t.Errorf("Expecting %s, got %s", expected, strings.Join(got, ","))
+	}
+}
@@ -0,0 +1,65 @@
+package iislog
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/simulot/golib/pipeline"
+)
+
+// fileDescription summarizes records of a log file
+type fileDescription struct {
+	name     string
+	from, to time.Time
+	count    int
+	servers  map[string]bool
+	fields   []string
+}
+
+// DescribeOperator creates an operator that reads record streams and reports
+// for each file its time frame, count of records, servers and fields
+func (a *Application) DescribeOperator() pipeline.Operator {
+	return func(in, out chan interface{}) {
+		descriptions := []*fileDescription{}
+		for i := range in {
+			s, ok := i.(*recordStream)
+			if !ok {
+				panic("Expecting *recordStream in pipeline.Operator DescribeOperator")
+			}
+			d := &fileDescription{name: s.file.item.Name(), servers: map[string]bool{}}
+			s.open()
+			for s.next() {
+				r := s.head
+				if d.count == 0 || r.DateTime.Before(d.from) {
+					d.from = r.DateTime
+				}
+				if r.DateTime.After(d.to) {
+					d.to = r.DateTime
+				}
+				d.count++
+				switch {
+				case r.ComputerName != "":
+					d.servers[r.ComputerName] = true
+				case r.Server != nil:
+					d.servers[r.Server.String()] = true
+				}
+				d.fields = r.Fields
+			}
+			descriptions = append(descriptions, d)
+		}
+
+		sort.Slice(descriptions, func(i, j int) bool { return descriptions[i].name < descriptions[j].name })
+		w := a.newRowWriter(a.out)
+		w.WriteHeader([]string{"file", "from", "to", "lines", "servers", "fields"})
+		for _, d := range descriptions {
+			servers := []string{}
+			for s := range d.servers {
+				servers = append(servers, s)
+			}
+			sort.Strings(servers)
+			w.WriteRow([]interface{}{d.name, d.from, d.to, d.count, strings.Join(servers, " "), strings.Join(d.fields, " ")})
+		}
+		w.Flush()
+	}
+}
@@ -0,0 +1,197 @@
+package iislog
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/simulot/iislog/iis"
+)
+
+// ecsFields gives the Elastic Common Schema field of log fields:
+// https://www.elastic.co/guide/en/ecs/current/index.html
+var ecsFields = map[string]string{
+	"s-sitename":      "iis.access.site_name",
+	"s-computername":  "host.name",
+	"s-ip":            "destination.ip",
+	"s-port":          "destination.port",
+	"c-ip":            "source.ip",
+	"cs-username":     "user.name",
+	"cs-method":       "http.request.method",
+	"cs-uri-stem":     "url.path",
+	"cs-uri-query":    "url.query",
+	"cs-version":      "http.version",
+	"cs-host":         "url.domain",
+	"cs(User-Agent)":  "user_agent.original",
+	"cs(Referer)":     "http.request.referrer",
+	"cs(Cookie)":      "iis.access.cookie",
+	"sc-status":       "http.response.status_code",
+	"sc-substatus":    "iis.access.sub_status",
+	"sc-win32-status": "iis.access.win32_status",
+	"sc-bytes":        "http.response.body.bytes",
+	"cs-bytes":        "http.request.body.bytes",
+}
+
+// setPath sets the value of a dotted path in nested objects
+func setPath(doc map[string]interface{}, path string, v interface{}) {
+	keys := strings.Split(path, ".")
+	for _, k := range keys[:len(keys)-1] {
+		child, ok := doc[k].(map[string]interface{})
+		if !ok {
+			child = map[string]interface{}{}
+			doc[k] = child
+		}
+		doc = child
+	}
+	doc[keys[len(keys)-1]] = v
+}
+
+// ecsDocument gives the fields read from the log as an ECS document
+func ecsDocument(r *iis.LogRecord) map[string]interface{} {
+	doc := map[string]interface{}{
+		"@timestamp": r.DateTime.Format("2006-01-02T15:04:05.000Z07:00"),
+		"event": map[string]interface{}{
+			"dataset":  "iis.access",
+			"kind":     "event",
+			"category": []string{"web"},
+		},
+	}
+	for _, f := range r.Fields {
+		var v interface{}
+		switch f {
+		case "date", "time":
+			continue
+		case "time-taken":
+			// Nanoseconds
+			setPath(doc, "event.duration", int64(r.TimeTaken))
+			continue
+		case "cs-version":
+			v = strings.TrimPrefix(r.Version, "HTTP/")
+		default:
+			v = jsonValue(r.Get(f))
+		}
+		if v == nil || v == "" {
+			continue
+		}
+		path, ok := ecsFields[f]
+		if !ok {
+			path = "iis.access." + strings.NewReplacer("-", "_", "(", "_", ")", "").Replace(strings.ToLower(f))
+		}
+		setPath(doc, path, v)
+	}
+	if r.Status > 0 {
+		outcome := "success"
+		if r.Status >= 400 {
+			outcome = "failure"
+		}
+		setPath(doc, "event.outcome", outcome)
+	}
+	if r.File != "" {
+		path := r.File
+		if r.Member != "" {
+			path += "[" + r.Member + "]"
+		}
+		setPath(doc, "log.file.path", path)
+		setPath(doc, "log.offset", r.Offset)
+	}
+	return doc
+}
+
+// documentID identifies the document of a record, by the name of its log, its
+// line and its content, so a record sent twice isn't duplicated
+func documentID(r *iis.LogRecord) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%d\x00%d\x00%s", filepath.Base(r.File), r.Member, r.Line, r.DateTime.UnixNano(), r.Raw)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// elasticsearchClient sends records to the _bulk API of Elasticsearch or OpenSearch,
+// into an index per day
+type elasticsearchClient struct {
+	url    string // _bulk endpoint
+	prefix string // Index names are prefix-yyyy.mm.dd
+}
+
+func newElasticsearchClient(server, prefix string) *elasticsearchClient {
+	return &elasticsearchClient{url: sinkEndpoint(server, "/_bulk"), prefix: prefix}
+}
+
+// bulkAction is the action line of a document
+type bulkAction struct {
+	Create struct {
+		Index string `json:"_index"`
+		ID    string `json:"_id"`
+	} `json:"create"`
+}
+
+func (c *elasticsearchClient) request(records []*iis.LogRecord) (*http.Request, error) {
+	body := bytes.NewBuffer(nil)
+	enc := json.NewEncoder(body)
+	enc.SetEscapeHTML(false)
+	action := bulkAction{}
+	for _, r := range records {
+		action.Create.Index = c.prefix + "-" + r.DateTime.Format("2006.01.02")
+		action.Create.ID = documentID(r)
+		if err := enc.Encode(action); err != nil {
+			return nil, err
+		}
+		if err := enc.Encode(ecsDocument(r)); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(http.MethodPost, c.url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	return req, nil
+}
+
+// bulkResponse is the response of the _bulk API, with the result of each action
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  *struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+// check gives documents refused because the server is busy. Documents already
+// created, on a previous run, aren't errors.
+func (c *elasticsearchClient) check(resp *http.Response, records []*iis.LogRecord) (retry []*iis.LogRecord, rejected []*iis.ParseError) {
+	bulk := bulkResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&bulk); err != nil {
+		return nil, []*iis.ParseError{{File: c.url, Err: err}}
+	}
+	if !bulk.Errors {
+		return nil, nil
+	}
+	for i, item := range bulk.Items {
+		if i >= len(records) {
+			break
+		}
+		for _, result := range item {
+			switch {
+			case result.Status < 300, result.Status == http.StatusConflict:
+			case result.Status == http.StatusTooManyRequests || result.Status >= 500:
+				retry = append(retry, records[i])
+			default:
+				err := fmt.Errorf("elasticsearch: status %d", result.Status)
+				if result.Error != nil {
+					err = fmt.Errorf("elasticsearch: %s: %s", result.Error.Type, result.Error.Reason)
+				}
+				r := records[i]
+				rejected = append(rejected, &iis.ParseError{File: r.File, Member: r.Member, Line: r.Line, Text: r.Raw, Err: err})
+			}
+		}
+	}
+	return retry, rejected
+}
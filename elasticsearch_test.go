@@ -0,0 +1,126 @@
+package iislog
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestElasticsearch(t *testing.T) {
+	sinkBackoff = time.Millisecond
+	defer func() { sinkBackoff = time.Second }()
+
+	// A fake _bulk endpoint, busy at the first request, and refusing the first
+	// document once
+	var (
+		mu       sync.Mutex
+		requests int
+		busy     = true
+		docs     = map[string]map[string]interface{}{}
+		indexes  = map[string]string{}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if r.URL.Path != "/_bulk" || r.Header.Get("Content-Type") != "application/x-ndjson" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if requests == 1 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		items := []string{}
+		errors := false
+		s := bufio.NewScanner(r.Body)
+		for s.Scan() {
+			action := bulkAction{}
+			json.Unmarshal(s.Bytes(), &action)
+			s.Scan()
+			doc := map[string]interface{}{}
+			json.Unmarshal(s.Bytes(), &doc)
+			status := 201
+			switch {
+			case docs[action.Create.ID] != nil:
+				status = 409
+				errors = true
+			case busy:
+				status = 429
+				errors = true
+				busy = false
+			default:
+				docs[action.Create.ID] = doc
+				indexes[action.Create.ID] = action.Create.Index
+			}
+			items = append(items, fmt.Sprintf(`{"create":{"status":%d}}`, status))
+		}
+		fmt.Fprintf(w, `{"errors":%t,"items":[%s]}`, errors, strings.Join(items, ","))
+	}))
+	defer srv.Close()
+
+	log := "#Date: 2017-01-31 23:00:00\r\n" +
+		"#Fields: date time s-sitename c-ip cs-method cs-uri-stem cs-version sc-status time-taken\r\n" +
+		"2017-01-31 23:59:00 W3SVC1 10.0.0.1 GET /a HTTP/1.1 200 15\r\n" +
+		"2017-02-01 00:01:00 W3SVC1 10.0.0.2 POST /b HTTP/1.1 500 1200\r\n" +
+		"2017-02-01 00:02:00 W3SVC1 10.0.0.2 GET /c HTTP/1.1 404 3\r\n"
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint.json")
+	ship := func(checkpoint string) {
+		a := NewApplication()
+		a.command = convertCommand
+		a.format = "elasticsearch"
+		a.output = srv.URL
+		a.esIndex = "iislog"
+		a.checkpoint = checkpoint
+		a.strict = true
+		if err := a.RunReaders(NamedReader{Name: "u_ex170131.log", Reader: strings.NewReader(log)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ship(checkpoint)
+	if requests != 3 || len(docs) != 3 {
+		t.Fatalf("Expecting 3 documents sent by 3 requests, got %d documents by %d requests", len(docs), requests)
+	}
+	days := map[string]int{}
+	for id, doc := range docs {
+		days[indexes[id]]++
+		if path := doc["url"].(map[string]interface{})["path"]; path == "/b" {
+			b, _ := json.Marshal(doc)
+			for _, expected := range []string{
+				`"@timestamp":"2017-02-01T00:01:00.000Z"`,
+				`"http":{"request":{"method":"POST"},"response":{"status_code":500},"version":"1.1"}`,
+				`"source":{"ip":"10.0.0.2"}`,
+				`"duration":1200000000`,
+				`"outcome":"failure"`,
+				`"iis":{"access":{"site_name":"W3SVC1"}}`,
+			} {
+				if !strings.Contains(string(b), expected) {
+					t.Errorf("Expecting %s in %s", expected, b)
+				}
+			}
+		}
+	}
+	if days["iislog-2017.01.31"] != 1 || days["iislog-2017.02.01"] != 2 {
+		t.Errorf("Expecting an index per day, got %v", days)
+	}
+
+	// Resumes after the last line sent
+	ship(checkpoint)
+	if requests != 3 {
+		t.Errorf("Expecting no more requests after the checkpoint, got %d", requests-3)
+	}
+
+	// Documents sent again aren't duplicated
+	ship("")
+	if requests != 4 || len(docs) != 3 {
+		t.Errorf("Expecting 3 documents after sending them again, got %d", len(docs))
+	}
+}
@@ -0,0 +1,146 @@
+package iislog
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/simulot/iislog/iis"
+)
+
+// maxReportedErrors is the number of errors detailed in the summary
+const maxReportedErrors = 10
+
+// parseErrors collects errors met while reading logs, and writes rejected lines
+type parseErrors struct {
+	sync.Mutex
+	strict  bool              // Stop at the first error
+	stop    func()            // Stops the pipeline
+	rejects *bufio.Writer     // Where rejected lines are written, if any
+	errors  []*iis.ParseError // First errors
+	count   int
+	files   map[string]int // Count of errors per file
+	failure error          // Error after which the application can't go on
+}
+
+func newParseErrors(strict bool, stop func(), rejects io.Writer) *parseErrors {
+	e := &parseErrors{
+		strict: strict,
+		stop:   stop,
+		files:  map[string]int{},
+	}
+	if rejects != nil {
+		e.rejects = bufio.NewWriter(rejects)
+	}
+	return e
+}
+
+// report records an error met in item. It returns false when the reading must stop.
+// A nil parseErrors writes errors on the console.
+func (e *parseErrors) report(item logItem, err error) bool {
+	pe, ok := err.(*iis.ParseError)
+	if !ok {
+		pe = &iis.ParseError{Err: err}
+	}
+	if item != nil {
+		pe.File, pe.Member = item.Source()
+	}
+	return e.add(pe)
+}
+
+// add records a parse error which source is known. It returns false when the reading must stop.
+func (e *parseErrors) add(pe *iis.ParseError) bool {
+	if e == nil {
+		fmt.Fprintln(os.Stderr, pe)
+		return true
+	}
+	e.Lock()
+	defer e.Unlock()
+	e.count++
+	if len(e.errors) < maxReportedErrors {
+		e.errors = append(e.errors, pe)
+	}
+	name := pe.File
+	if pe.Member != "" {
+		name += "[" + pe.Member + "]"
+	}
+	e.files[name]++
+	if e.rejects != nil && pe.Line > 0 {
+		fmt.Fprintf(e.rejects, "# %s\n%s\n", pe, pe.Text)
+	}
+	if e.strict {
+		e.stop()
+		return false
+	}
+	return true
+}
+
+// fail records an error after which the application can't go on, like an output
+// that can't be written. The pipeline stops, and the error is returned by run.
+func (e *parseErrors) fail(pe *iis.ParseError) {
+	e.Lock()
+	if e.failure == nil {
+		e.failure = pe
+	}
+	e.Unlock()
+	if e.stop != nil {
+		e.stop()
+	}
+}
+
+// failed returns the error given to fail, nil if none
+func (e *parseErrors) failed() error {
+	e.Lock()
+	defer e.Unlock()
+	return e.failure
+}
+
+// reported returns the count of errors, and the first ones
+func (e *parseErrors) reported() (int, []*iis.ParseError) {
+	e.Lock()
+	defer e.Unlock()
+	return e.count, append([]*iis.ParseError(nil), e.errors...)
+}
+
+// first returns the first error, nil if none
+func (e *parseErrors) first() error {
+	e.Lock()
+	defer e.Unlock()
+	if len(e.errors) == 0 {
+		return nil
+	}
+	return e.errors[0]
+}
+
+// close writes the rejected lines, and a summary of errors on w
+func (e *parseErrors) close(w io.Writer) error {
+	e.Lock()
+	defer e.Unlock()
+	if e.rejects != nil {
+		if err := e.rejects.Flush(); err != nil {
+			return err
+		}
+	}
+	if e.count == 0 || e.strict {
+		return nil
+	}
+	fmt.Fprintf(w, "%d errors in %d files:\n", e.count, len(e.files))
+	for _, pe := range e.errors {
+		fmt.Fprintln(w, pe)
+	}
+	if e.count > len(e.errors) {
+		fmt.Fprintf(w, "... and %d more errors\n", e.count-len(e.errors))
+		names := []string{}
+		for name := range e.files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(w, "%s: %d errors\n", name, e.files[name])
+		}
+	}
+	return nil
+}
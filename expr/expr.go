@@ -0,0 +1,519 @@
+// Package expr implements the small expression language used to select log
+// records, like:
+//
+//	status >= 500 && (uri ~ "^/api/" || user == "DOMAIN\\svc") && time-taken > 2s && !(c-ip in 10.0.0.0/8)
+//
+// Fields are named after the W3C fields (cs-uri-stem, c-ip...) or their
+// short aliases (uri, ip...), query parameters as param(name), and headers
+// as cs(name) or sc(name). Other W3C fields, like s-event, are read from the
+// fields IIS logs and iislog doesn't know. Names not shaped like W3C fields
+// are errors. Literals are typed after the field they are
+// compared to: numbers, durations (200ms, 2s), IP addresses and networks,
+// dates or strings. Operators are ==, !=, <, <=, >, >=, ~ and !~ for regular
+// expressions, in and !in for lists and networks, combined with &&, || and !.
+package expr
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/simulot/iislog/iis"
+)
+
+// Expr is a compiled expression. It implements iis.RecordFilter and
+// iis.RecordChecker, so records are abandoned as soon as a field
+// makes the expression false.
+type Expr struct {
+	src   string
+	root  node
+	early map[string][]node // Top level conjunctions depending on a single field
+}
+
+// aliases gives short names to W3C fields
+var aliases = map[string]string{
+	"status":       "sc-status",
+	"substatus":    "sc-substatus",
+	"win32-status": "sc-win32-status",
+	"uri":          "cs-uri-stem",
+	"url":          "cs-uri-stem",
+	"stem":         "cs-uri-stem",
+	"query":        "cs-uri-query",
+	"user":         "cs-username",
+	"method":       "cs-method",
+	"ip":           "c-ip",
+	"client":       "c-ip",
+	"server":       "s-ip",
+	"port":         "s-port",
+	"host":         "cs-host",
+	"agent":        "cs(User-Agent)",
+	"user-agent":   "cs(User-Agent)",
+	"referer":      "cs(Referer)",
+	"cookie":       "cs(Cookie)",
+	"bytes":        "sc-bytes",
+	"sent":         "sc-bytes",
+	"received":     "cs-bytes",
+	"sitename":     "s-sitename",
+	"computer":     "s-computername",
+	"datetime":     "DateTime",
+	"file":         "source-file",
+	"member":       "source-member",
+	"offset":       "source-offset",
+	"line":         "source-line",
+}
+
+// Field returns the W3C name of a field given by its alias
+func Field(name string) string {
+	if f, ok := aliases[strings.ToLower(name)]; ok {
+		return f
+	}
+	return name
+}
+
+// w3cField matches W3C field names, like s-event or x-forwarded-for, and
+// headers, like cs(X-Forwarded-For)
+var w3cField = regexp.MustCompile(`^(?:c|s|r|cs|sc|sr|rs|x)(?:-[A-Za-z0-9][A-Za-z0-9_-]*|\(.+\))$`)
+
+// checkField returns an error when the field is neither known nor named like a
+// W3C field, so a typo isn't compiled into a test that never matches. Other
+// W3C fields are read from the Other fields of records.
+func checkField(field string) error {
+	switch {
+	case iis.IsKnownField(field):
+	case strings.HasPrefix(field, "param(") && strings.HasSuffix(field, ")") && len(field) > len("param()"):
+	case w3cField.MatchString(field):
+	default:
+		return fmt.Errorf("unknown field %s", field)
+	}
+	return nil
+}
+
+// Aliases returns the short names of fields, with their W3C names
+func Aliases() map[string]string {
+	m := make(map[string]string, len(aliases))
+	for k, v := range aliases {
+		m[k] = v
+	}
+	return m
+}
+
+// Compile parses an expression
+func Compile(src string) (*Expr, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tEOF {
+		return nil, fmt.Errorf("unexpected %s at position %d", t, t.pos)
+	}
+
+	e := &Expr{
+		src:   src,
+		root:  root,
+		early: map[string][]node{},
+	}
+	e.splitConjunctions(root)
+	return e, nil
+}
+
+// MustCompile is like Compile but panics if the expression can't be parsed
+func MustCompile(src string) *Expr {
+	e, err := Compile(src)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+// splitConjunctions collects the top level terms of the expression that
+// depend on only one field. They can be checked as soon as the field is read.
+func (e *Expr) splitConjunctions(n node) {
+	if a, ok := n.(*andNode); ok {
+		e.splitConjunctions(a.l)
+		e.splitConjunctions(a.r)
+		return
+	}
+	fields := map[string]bool{}
+	n.fields(fields)
+	if len(fields) != 1 {
+		return
+	}
+	for f := range fields {
+		switch f {
+		case "DateTime", "sc-substatus":
+			// Not reliably known while the line is read
+			continue
+		}
+		e.early[f] = append(e.early[f], n)
+	}
+}
+
+// String returns the source of the expression
+func (e *Expr) String() string { return e.src }
+
+// Match evaluates the expression against a record
+func (e *Expr) Match(r *iis.LogRecord) bool {
+	return e.root.eval(r.Get)
+}
+
+// Values gives the values the field must have for the expression to be true, in
+// their string form, when the expression requires it to be equal to one value of
+// a list, like status == 500 or status in (500, 503). ok is false otherwise.
+func (e *Expr) Values(field string) (values []string, ok bool) {
+	field = Field(field)
+	for _, n := range e.early[field] {
+		v, restricts := nodeValues(n)
+		if !restricts {
+			continue
+		}
+		if !ok {
+			values, ok = v, true
+			continue
+		}
+		// Both conditions must be true
+		both := []string{}
+		for _, a := range values {
+			for _, b := range v {
+				if a == b {
+					both = append(both, a)
+				}
+			}
+		}
+		values = both
+	}
+	return values, ok
+}
+
+// nodeValues gives the values accepted by a test node, or a disjunction of them
+func nodeValues(n node) ([]string, bool) {
+	switch n := n.(type) {
+	case *testNode:
+		return n.values, n.values != nil
+	case *orNode:
+		l, ok := nodeValues(n.l)
+		if !ok {
+			return nil, false
+		}
+		r, ok := nodeValues(n.r)
+		if !ok {
+			return nil, false
+		}
+		return append(append([]string{}, l...), r...), true
+	}
+	return nil, false
+}
+
+// MayMatch returns false when the expression can't be true for records which
+// field has one of the values. It returns true when the expression has no
+// condition on the field alone.
+func (e *Expr) MayMatch(field string, values []interface{}) bool {
+	nodes := e.early[Field(field)]
+	if len(nodes) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if e.checkEarly(Field(field), v) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckFullLine implements iis.RecordFilter
+func (e *Expr) CheckFullLine(line *string) bool { return true }
+
+// CheckDate implements iis.RecordFilter
+func (e *Expr) CheckDate(date time.Time) bool { return true }
+
+// CheckField implements iis.RecordFilter
+func (e *Expr) CheckField(field string, value interface{}) bool {
+	return e.checkEarly(field, value)
+}
+
+// CheckError implements iis.RecordFilter. The status isn't known yet when
+// sc-substatus comes before sc-status in the line.
+func (e *Expr) CheckError(status, substatus int) bool {
+	if status == 0 {
+		return true
+	}
+	return e.checkEarly("sc-status", status)
+}
+
+// CheckRecord implements iis.RecordChecker
+func (e *Expr) CheckRecord(r *iis.LogRecord) bool {
+	return e.Match(r)
+}
+
+func (e *Expr) checkEarly(field string, value interface{}) bool {
+	for _, n := range e.early[field] {
+		if !n.eval(func(string) interface{} { return value }) {
+			return false
+		}
+	}
+	return true
+}
+
+// ------------------------ nodes --------------------------------------
+
+type getter func(field string) interface{}
+
+type node interface {
+	eval(get getter) bool
+	fields(m map[string]bool)
+}
+
+type andNode struct{ l, r node }
+
+func (n *andNode) eval(get getter) bool { return n.l.eval(get) && n.r.eval(get) }
+func (n *andNode) fields(m map[string]bool) {
+	n.l.fields(m)
+	n.r.fields(m)
+}
+
+type orNode struct{ l, r node }
+
+func (n *orNode) eval(get getter) bool { return n.l.eval(get) || n.r.eval(get) }
+func (n *orNode) fields(m map[string]bool) {
+	n.l.fields(m)
+	n.r.fields(m)
+}
+
+type notNode struct{ n node }
+
+func (n *notNode) eval(get getter) bool     { return !n.n.eval(get) }
+func (n *notNode) fields(m map[string]bool) { n.n.fields(m) }
+
+// testNode checks the value of one field
+type testNode struct {
+	field  string
+	test   func(v interface{}) bool
+	values []string // Values accepted by an equality test, in their string form
+}
+
+func (n *testNode) eval(get getter) bool     { return n.test(get(n.field)) }
+func (n *testNode) fields(m map[string]bool) { m[n.field] = true }
+
+// ------------------------ compilation ---------------------------------
+
+// zero is used to discover the type of fields
+var zero = iis.NewLogRecord("", nil)
+
+func compileComparison(field, op, literal string) (node, error) {
+	field = Field(field)
+	if err := checkField(field); err != nil {
+		return nil, err
+	}
+	switch op {
+	case "=":
+		op = "=="
+	case "=~":
+		op = "~"
+	}
+
+	if op == "~" || op == "!~" {
+		re, err := regexp.Compile(literal)
+		if err != nil {
+			return nil, err
+		}
+		want := op == "~"
+		return &testNode{field: field, test: func(v interface{}) bool {
+			return re.MatchString(toString(v)) == want
+		}}, nil
+	}
+
+	var cmp func(v interface{}) int
+	switch zero.Get(field).(type) {
+	case int, int64:
+		l, err := strconv.ParseInt(literal, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s expects a number, got %q", field, literal)
+		}
+		cmp = func(v interface{}) int { return compareInt(toInt(v), l) }
+	case time.Duration:
+		l, err := parseDuration(literal)
+		if err != nil {
+			return nil, fmt.Errorf("%s expects a duration, got %q", field, literal)
+		}
+		cmp = func(v interface{}) int { return compareInt(int64(v.(time.Duration)), int64(l)) }
+	case time.Time:
+		l, err := parseTime(literal)
+		if err != nil {
+			return nil, fmt.Errorf("%s expects a date, got %q", field, literal)
+		}
+		cmp = func(v interface{}) int {
+			t := v.(time.Time)
+			switch {
+			case t.Before(l):
+				return -1
+			case t.After(l):
+				return 1
+			}
+			return 0
+		}
+	case net.IP:
+		if op != "==" && op != "!=" {
+			return nil, fmt.Errorf("operator %s can't be used with %s", op, field)
+		}
+		l := net.ParseIP(literal)
+		if l == nil {
+			return nil, fmt.Errorf("%s expects an IP address, got %q", field, literal)
+		}
+		cmp = func(v interface{}) int {
+			if l.Equal(v.(net.IP)) {
+				return 0
+			}
+			return 1
+		}
+	default:
+		cmp = func(v interface{}) int { return strings.Compare(toString(v), literal) }
+	}
+
+	var test func(c int) bool
+	switch op {
+	case "==":
+		test = func(c int) bool { return c == 0 }
+	case "!=":
+		test = func(c int) bool { return c != 0 }
+	case "<":
+		test = func(c int) bool { return c < 0 }
+	case "<=":
+		test = func(c int) bool { return c <= 0 }
+	case ">":
+		test = func(c int) bool { return c > 0 }
+	case ">=":
+		test = func(c int) bool { return c >= 0 }
+	default:
+		return nil, fmt.Errorf("unknown operator %s", op)
+	}
+	n := &testNode{field: field, test: func(v interface{}) bool { return test(cmp(v)) }}
+	if op == "==" {
+		switch zero.Get(field).(type) {
+		case int, int64:
+			l, _ := strconv.ParseInt(literal, 10, 64)
+			n.values = []string{strconv.FormatInt(l, 10)}
+		case net.IP:
+			n.values = []string{net.ParseIP(literal).String()}
+		case string:
+			n.values = []string{literal}
+		}
+	}
+	return n, nil
+}
+
+// compileIn makes a test for membership in a list of values. For IP addresses,
+// values can be networks in CIDR notation.
+func compileIn(field string, literals []string) (node, error) {
+	field = Field(field)
+	if err := checkField(field); err != nil {
+		return nil, err
+	}
+	if _, ok := zero.Get(field).(net.IP); ok {
+		nets := []*net.IPNet{}
+		values := []string{} // When all literals are addresses
+		for _, l := range literals {
+			if !strings.Contains(l, "/") {
+				if ip := net.ParseIP(l); ip != nil {
+					values = append(values, ip.String())
+					bits := 8 * net.IPv6len
+					if ip.To4() != nil {
+						bits = 8 * net.IPv4len
+					}
+					l += "/" + strconv.Itoa(bits)
+				}
+			}
+			_, n, err := net.ParseCIDR(l)
+			if err != nil {
+				return nil, fmt.Errorf("%s expects IP addresses or networks, got %q", field, l)
+			}
+			nets = append(nets, n)
+		}
+		n := &testNode{field: field, test: func(v interface{}) bool {
+			ip := v.(net.IP)
+			for _, n := range nets {
+				if n.Contains(ip) {
+					return true
+				}
+			}
+			return false
+		}}
+		if len(values) == len(literals) {
+			n.values = values
+		}
+		return n, nil
+	}
+
+	var or node
+	for _, l := range literals {
+		n, err := compileComparison(field, "==", l)
+		if err != nil {
+			return nil, err
+		}
+		if or == nil {
+			or = n
+		} else {
+			or = &orNode{or, n}
+		}
+	}
+	return or, nil
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func toInt(v interface{}) int64 {
+	switch i := v.(type) {
+	case int:
+		return int64(i)
+	case int64:
+		return i
+	}
+	return 0
+}
+
+func toString(v interface{}) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case nil:
+		return ""
+	case net.IP:
+		if s == nil {
+			return ""
+		}
+	}
+	return fmt.Sprint(v)
+}
+
+// parseDuration accepts Go durations, or milliseconds like the time-taken field
+func parseDuration(s string) (time.Duration, error) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+	return time.ParseDuration(s)
+}
+
+var timeLayouts = []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", time.RFC3339, "2006-01-02"}
+
+func parseTime(s string) (t time.Time, err error) {
+	for _, layout := range timeLayouts {
+		if t, err = time.ParseInLocation(layout, s, time.UTC); err == nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,153 @@
+package expr
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/simulot/iislog/iis"
+)
+
+const testLog = `#Fields: date time s-ip cs-method cs-uri-stem cs-uri-query cs-username c-ip sc-status sc-substatus time-taken
+2017-01-31 09:08:40 10.30.136.200 GET /api/orders - DOMAIN\user 10.1.2.3 500 0 2246
+2017-01-31 09:08:41 10.30.136.200 GET /api/orders - DOMAIN\svc 192.168.1.12 503 2 3000
+2017-01-31 09:08:42 10.30.136.200 GET /myapp/ - DOMAIN\svc 192.168.1.12 500 0 2500
+2017-01-31 09:08:43 10.30.136.200 POST /api/users - DOMAIN\bob 192.168.1.12 404 0 2500
+2017-01-31 09:08:44 10.30.136.200 GET /api/users - DOMAIN\bob 192.168.1.12 500 0 100
+`
+
+func TestExpression(t *testing.T) {
+	tests := []struct {
+		expr  string
+		lines []int // expected selected lines
+	}{
+		{`status >= 500 && (uri ~ "^/api/" || user == "DOMAIN\\svc") && time-taken > 2s && !(c-ip in 10.0.0.0/8)`, []int{2, 3}},
+		{`status == 500`, []int{1, 3, 5}},
+		{`status in (404, 503)`, []int{2, 4}},
+		{`user == 'DOMAIN\bob' || substatus = 2`, []int{2, 4, 5}},
+		{`method != GET`, []int{4}},
+		{`c-ip !in (10.1.2.3, 192.168.0.0/24)`, []int{2, 3, 4, 5}},
+		{`time-taken <= 2246`, []int{1, 5}},
+		{`datetime >= "2017-01-31 09:08:43"`, []int{4, 5}},
+		{`uri !~ api`, []int{3}},
+		{`param(id) == 1 || cs(X-Forwarded-For) != ""`, []int{}},
+	}
+
+	for _, tc := range tests {
+		e, err := Compile(tc.expr)
+		if err != nil {
+			t.Errorf("Compile(%s): %v", tc.expr, err)
+			continue
+		}
+		got := []int{}
+		for r := range iis.NewLogParser(strings.NewReader(testLog)).Parse(e) {
+			got = append(got, r.DateTime.Second()-39)
+		}
+		if len(got) != len(tc.lines) {
+			t.Errorf("%s: expecting lines %v, got %v", tc.expr, tc.lines, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.lines[i] {
+				t.Errorf("%s: expecting lines %v, got %v", tc.expr, tc.lines, got)
+				break
+			}
+		}
+	}
+}
+
+func TestSubstatusFirst(t *testing.T) {
+	log := "#Fields: date time cs-uri-stem sc-substatus sc-status\n" +
+		"2017-01-31 09:08:40 /a 0 500\n" +
+		"2017-01-31 09:08:41 /b 0 200\n" +
+		"2017-01-31 09:08:42 /c 2 503\n"
+	e := MustCompile(`status >= 500`)
+	got := []string{}
+	for r := range iis.NewLogParser(strings.NewReader(log)).Parse(e) {
+		got = append(got, r.URI)
+	}
+	if strings.Join(got, " ") != "/a /c" {
+		t.Errorf("Expecting /a /c, got %v", got)
+	}
+}
+
+func TestOtherFields(t *testing.T) {
+	log := "#Fields: date time s-event cs-uri-stem sc-status x-forwarded-for\n" +
+		"2017-01-31 09:08:40 Log /a 200 10.0.0.1\n" +
+		"2017-01-31 09:08:41 Periodic /b 200 10.0.0.2\n" +
+		"2017-01-31 09:08:42 Log /c 500 -\n"
+	tests := map[string]string{
+		`s-event == Log`:                       "/a /c",
+		`s-event != Log && status == 200`:      "/b",
+		`x-forwarded-for ~ "^10\\.0\\.0\\.2$"`: "/b",
+	}
+	for src, expected := range tests {
+		e, err := Compile(src)
+		if err != nil {
+			t.Errorf("Compile(%s): %v", src, err)
+			continue
+		}
+		got := []string{}
+		for r := range iis.NewLogParser(strings.NewReader(log)).Parse(e) {
+			got = append(got, r.URI)
+		}
+		if strings.Join(got, " ") != expected {
+			t.Errorf("%s: expecting %s, got %v", src, expected, got)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, s := range []string{
+		``,
+		`status >=`,
+		`status >= abc`,
+		`time-taken > fast`,
+		`c-ip > 10.0.0.1`,
+		`c-ip in 10.0.0.300/8`,
+		`(status == 500`,
+		`status == 500 )`,
+		`uri ~ "("`,
+		`user == "unterminated`,
+		`stauts >= 500`,
+		`stauts in (500, 503)`,
+		`time_taken > 2s`,
+		`x- == 1`,
+		`param() == 1`,
+	} {
+		if _, err := Compile(s); err == nil {
+			t.Errorf("Compile(%s): expecting an error", s)
+		}
+	}
+}
+
+func TestValues(t *testing.T) {
+	tests := []struct {
+		expr   string
+		field  string
+		values string
+		ok     bool
+	}{
+		{`status == 500 && uri ~ "^/api"`, "sc-status", "500", true},
+		{`status in (500, 503) && status != 503`, "status", "500,503", true},
+		{`status in (500, 503) && status == 503`, "status", "503", true},
+		{`(user == "a" || user == "b") && status >= 500`, "user", "a,b", true},
+		{`c-ip in (10.0.0.1, 10.0.0.2)`, "ip", "10.0.0.1,10.0.0.2", true},
+		{`c-ip in 10.0.0.0/8`, "ip", "", false},
+		{`user == "a" || status == 500`, "user", "", false},
+		{`uri ~ "^/api"`, "uri", "", false},
+	}
+	for _, tc := range tests {
+		values, ok := MustCompile(tc.expr).Values(tc.field)
+		if ok != tc.ok || strings.Join(values, ",") != tc.values {
+			t.Errorf("%s: expecting %s values %q, %v, got %q, %v", tc.expr, tc.field, tc.values, tc.ok, strings.Join(values, ","), ok)
+		}
+	}
+
+	e := MustCompile(`status >= 500 && user ~ "^DOMAIN"`)
+	if e.MayMatch("status", []interface{}{200, 404}) || !e.MayMatch("status", []interface{}{200, 503}) {
+		t.Errorf("Unexpected MayMatch on status")
+	}
+	if !e.MayMatch("uri", []interface{}{"/x"}) {
+		t.Errorf("Expecting MayMatch for a field without condition")
+	}
+}
@@ -0,0 +1,251 @@
+package expr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// token kinds
+const (
+	tEOF    = iota
+	tWord   // field name or bare literal: status, 500, 2s, 10.0.0.0/8
+	tString // quoted literal
+	tOp     // operators and punctuation
+)
+
+type token struct {
+	kind int
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+// operators, longest first
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "!~", "=~", "<", ">", "~", "!", "(", ")", ",", "="}
+
+// lex splits the source into tokens
+func lex(src string) ([]token, error) {
+	tokens := []token{}
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+
+		case c == '"':
+			// Go like string with escapes
+			j := i + 1
+			for ; j < len(src) && src[j] != '"'; j++ {
+				if src[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string at position %d", i)
+			}
+			s, err := strconv.Unquote(src[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at position %d: %v", i, err)
+			}
+			tokens = append(tokens, token{tString, s, i})
+			i = j + 1
+
+		case c == '\'':
+			// raw string, handy for windows user names
+			j := strings.IndexByte(src[i+1:], '\'')
+			if j < 0 {
+				return nil, fmt.Errorf("unterminated string at position %d", i)
+			}
+			tokens = append(tokens, token{tString, src[i+1 : i+1+j], i})
+			i += j + 2
+
+		default:
+			op := ""
+			for _, o := range operators {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op != "" {
+				tokens = append(tokens, token{tOp, op, i})
+				i += len(op)
+				continue
+			}
+			j := i
+			for j < len(src) && !strings.ContainsRune(" \t\r\n\"'()!,&|=<>~", rune(src[j])) {
+				j++
+			}
+			// Headers fields like cs(User-Agent) keep their parenthesis
+			if j < len(src) && src[j] == '(' && src[i:j] != "in" {
+				if k := strings.IndexByte(src[j:], ')'); k > 0 {
+					j += k + 1
+				}
+			}
+			tokens = append(tokens, token{tWord, src[i:j], i})
+			i = j
+		}
+	}
+	return append(tokens, token{tEOF, "", len(src)}), nil
+}
+
+// parser is a recursive descent parser for the expression grammar:
+//
+//	or         = and { "||" and }
+//	and        = unary { "&&" unary }
+//	unary      = "!" unary | "(" or ")" | comparison
+//	comparison = field op value | field ["!"] "in" ( value | "(" value { "," value } ")" )
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token { return p.tokens[p.pos] }
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) accept(op string) bool {
+	if t := p.peek(); t.kind == tOp && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(op string) error {
+	if !p.accept(op) {
+		t := p.peek()
+		return fmt.Errorf("expecting %q at position %d, got %s", op, t.pos, t)
+	}
+	return nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l = &orNode{l, r}
+	}
+	return l, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	l, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		r, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l = &andNode{l, r}
+	}
+	return l, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.accept("!") {
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{n}, nil
+	}
+	if p.accept("(") {
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return n, p.expect(")")
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (node, error) {
+	t := p.next()
+	if t.kind != tWord {
+		return nil, fmt.Errorf("expecting a field name at position %d, got %s", t.pos, t)
+	}
+	field := t.text
+
+	op := p.next()
+	negate := false
+	if op.kind == tOp && op.text == "!" {
+		// field !in (...)
+		negate = true
+		op = p.next()
+	}
+	switch {
+	case op.kind == tWord && op.text == "in":
+		values, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+		n, err := compileIn(field, values)
+		if err != nil {
+			return nil, fmt.Errorf("at position %d: %v", t.pos, err)
+		}
+		if negate {
+			return &notNode{n}, nil
+		}
+		return n, nil
+	case negate, op.kind != tOp:
+		return nil, fmt.Errorf("expecting an operator after %q at position %d, got %s", field, op.pos, op)
+	}
+
+	v := p.next()
+	if v.kind != tWord && v.kind != tString {
+		return nil, fmt.Errorf("expecting a value after %q at position %d, got %s", op.text, v.pos, v)
+	}
+	n, err := compileComparison(field, op.text, v.text)
+	if err != nil {
+		return nil, fmt.Errorf("at position %d: %v", t.pos, err)
+	}
+	return n, nil
+}
+
+// parseList reads the right side of the in operator
+func (p *parser) parseList() ([]string, error) {
+	if !p.accept("(") {
+		v := p.next()
+		if v.kind != tWord && v.kind != tString {
+			return nil, fmt.Errorf("expecting a value after \"in\" at position %d, got %s", v.pos, v)
+		}
+		return []string{v.text}, nil
+	}
+	values := []string{}
+	for {
+		v := p.next()
+		if v.kind != tWord && v.kind != tString {
+			return nil, fmt.Errorf("expecting a value at position %d, got %s", v.pos, v)
+		}
+		values = append(values, v.text)
+		if p.accept(")") {
+			return values, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
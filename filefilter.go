@@ -1,29 +1,222 @@
 package iislog
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
 	"time"
 
-	"github.com/simulot/golib/file/walker"
 	"github.com/simulot/golib/pipeline"
+	"github.com/simulot/iislog/iis"
 )
 
+// logFile is a log file selected for parsing, with the time frame it covers
+type logFile struct {
+	item     logItem
+	from, to time.Time     // Time frame covered by the file, zero when unknown
+	reader   io.Reader     // Reader already opened to peek into the file, if any
+	path     string        // File on disk closed after peeking into it, reopened when read
+	reopened *os.File      // File reopened from path
+	blocks   []*blockIndex // Blocks to be read according to the index, nil for the whole file
+	store    bool          // The file is a store written by convert
+}
+
 // FileFilterOperator create a file filter for the application pipeline
 func (a *Application) FileFilterOperator() pipeline.Operator {
 	return func(in, out chan interface{}) {
-		from, to := a.dateFrom.Truncate(24*time.Hour), a.dateTo.Truncate(24*time.Hour).AddDate(0, 0, 1)
 		for i := range in {
-			if item, ok := i.(walker.WalkItem); ok {
-				if fd, err := time.ParseInLocation("u_ex060102.log", item.Name(), time.UTC); err == nil {
-					// Check if the file date fits with searched date range
-					if from.Before(fd) && fd.Before(to) {
-						out <- item
+			if item, ok := i.(logItem); ok {
+				if strings.EqualFold(path.Ext(item.Name()), storeExt) {
+					// Stores are read block by block
+					out <- &logFile{item: item, store: true}
+					continue
+				}
+				if strings.HasSuffix(item.Name(), indexSuffix) {
+					// Index files are read with their log
+					item.Close()
+					continue
+				}
+				file := &logFile{item: item}
+				if blocks, from, to, ok := a.indexedBlocks(item); ok && a.command != indexCommand {
+					if blocks != nil && len(blocks) == 0 {
+						// No record of the file can match
+						item.Close()
+						continue
+					}
+					file.from, file.to, file.blocks = from, to, blocks
+				} else if from, to, ok := fileFrame(item.Name()); ok {
+					file.from, file.to = from, to
+				} else {
+					// No date in the name, like the standard input or renamed logs, look at the content
+					r, err := item.Reader()
+					if err != nil {
+						a.errs.report(item, err)
+						item.Close()
+						continue
+					}
+					if file.from, file.to, file.reader, ok = peekFrame(r); !ok {
+						a.skip(item)
+						item.Close()
+						continue
+					}
+					if f, isFile := file.reader.(*os.File); isFile && f != os.Stdin {
+						// Files wait for the merge, don't keep them open until then
+						file.path, file.reader = f.Name(), nil
+						f.Close()
 					}
+				}
+
+				// Check if the file time frame overlaps the searched date range
+				if !file.from.After(a.dateTo) && (file.to.IsZero() || file.to.After(a.dateFrom)) {
+					out <- file
 				} else {
 					item.Close()
 				}
 			} else {
-				panic("Expecting walker.WalkItem in pipeline.Operator filter")
+				panic("Expecting logItem in pipeline.Operator filter")
+			}
+		}
+	}
+}
+
+// errNotLog tells why a file is skipped
+var errNotLog = errors.New("skipped, not an IIS log")
+
+// skip reports in verbose mode a file which isn't an IIS log
+func (a *Application) skip(item logItem) {
+	if a.verbose {
+		file, member := item.Source()
+		fmt.Fprintln(os.Stderr, &iis.ParseError{File: file, Member: member, Err: errNotLog})
+	}
+}
+
+// open gives the reader of the file
+func (f *logFile) open() (io.Reader, error) {
+	switch {
+	case f.reader != nil:
+		return f.reader, nil
+	case f.path != "":
+		var err error
+		f.reopened, err = os.Open(f.path)
+		if err != nil {
+			return nil, err
+		}
+		return f.reopened, nil
+	}
+	return f.item.Reader()
+}
+
+// close closes the file
+func (f *logFile) close() error {
+	if f.reopened != nil {
+		f.reopened.Close()
+	}
+	return f.item.Close()
+}
+
+// IIS log file names: u_ex for UTF-8 logs, ex for ASCII logs, followed by the date
+var logFileName = regexp.MustCompile(`(?i)^(?:u_)?ex(\d{4}|\d{6}|\d{8})\.log$`)
+
+// IIS log file names of size based rollover, without date
+var extendFileName = regexp.MustCompile(`(?i)^(?:u_)?extend\d+\.log$`)
+
+// isLogFileName tells if the file is named like the logs IIS writes
+func isLogFileName(name string) bool {
+	return logFileName.MatchString(name) || extendFileName.MatchString(name)
+}
+
+// fileFrame gives the time frame covered by a log file according to IIS naming
+// schemes: u_exYYMMDD.log for daily logs, u_exYYMMDDHH.log for hourly logs and
+// u_exYYMM.log for monthly logs. It returns false when the name has no date, like
+// u_extendN.log for size based rollover, or renamed files.
+func fileFrame(name string) (from, to time.Time, ok bool) {
+	m := logFileName.FindStringSubmatch(name)
+	if m == nil {
+		return
+	}
+	var err error
+	switch len(m[1]) {
+	case 4:
+		from, err = time.ParseInLocation("0601", m[1], time.UTC)
+		to = from.AddDate(0, 1, 0)
+	case 6:
+		from, err = time.ParseInLocation("060102", m[1], time.UTC)
+		to = from.AddDate(0, 0, 1)
+	case 8:
+		from, err = time.ParseInLocation("06010215", m[1], time.UTC)
+		to = from.Add(time.Hour)
+	}
+	return from, to, err == nil
+}
+
+// peekSize is the size of the beginning and the end of files read to find their time frame
+const peekSize = 64 * 1024
+
+// peekFrame reads the #Date directive and, when the reader can seek, the last record
+// of a file to find its time frame. It returns a reader on the whole file, and false
+// when the file isn't a W3C log.
+func peekFrame(r io.Reader) (from, to time.Time, rr io.Reader, ok bool) {
+	var head, tail []byte
+	rs, isSeeker := r.(io.ReadSeeker)
+	if isSeeker {
+		// Pipes, like the standard input, are files that can't seek
+		_, err := rs.Seek(0, io.SeekCurrent)
+		isSeeker = err == nil
+	}
+	if isSeeker {
+		head = make([]byte, peekSize)
+		n, _ := io.ReadFull(rs, head)
+		head = head[:n]
+		if size, err := rs.Seek(0, io.SeekEnd); err == nil {
+			if size > peekSize {
+				size = peekSize
+			}
+			if _, err = rs.Seek(-size, io.SeekEnd); err == nil {
+				tail = make([]byte, size)
+				n, _ = io.ReadFull(rs, tail)
+				tail = tail[:n]
+			}
+		}
+		if _, err := rs.Seek(0, io.SeekStart); err != nil {
+			return
+		}
+		rr = rs
+	} else {
+		br := bufio.NewReaderSize(r, peekSize)
+		head, _ = br.Peek(peekSize)
+		rr = br
+	}
+
+	if len(head) == 0 || head[0] != '#' {
+		return
+	}
+	ok = true
+
+	// The #Date directive gives the creation of the file
+	for _, line := range bytes.Split(head, []byte("\n")) {
+		line = bytes.TrimRight(line, "\r")
+		if bytes.HasPrefix(line, []byte("#Date: ")) {
+			from, _ = time.ParseInLocation("2006-01-02 15:04:05", string(line[len("#Date: "):]), time.UTC)
+			break
+		}
+	}
+
+	// The last record gives the end of the file
+	lines := bytes.Split(bytes.TrimRight(tail, "\r\n"), []byte("\n"))
+	for i := len(lines) - 1; i > 0; i-- {
+		line := lines[i]
+		if len(line) >= 19 && line[0] != '#' {
+			if t, err := time.ParseInLocation("2006-01-02 15:04:05", string(line[:19]), time.UTC); err == nil {
+				to = t.Add(time.Second)
 			}
+			break
 		}
 	}
+	return
 }
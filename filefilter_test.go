@@ -0,0 +1,114 @@
+package iislog
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileFrame(t *testing.T) {
+	date := func(s string) time.Time {
+		d, _ := time.ParseInLocation("2006-01-02 15", s, time.UTC)
+		return d
+	}
+	tests := []struct {
+		name     string
+		ok       bool
+		from, to time.Time
+	}{
+		{"u_ex170131.log", true, date("2017-01-31 00"), date("2017-02-01 00")},
+		{"ex170131.log", true, date("2017-01-31 00"), date("2017-02-01 00")},
+		{"u_ex17013109.log", true, date("2017-01-31 09"), date("2017-01-31 10")},
+		{"u_ex1701.log", true, date("2017-01-01 00"), date("2017-02-01 00")},
+		{"U_EX170131.LOG", true, date("2017-01-31 00"), date("2017-02-01 00")},
+		{"u_extend12.log", false, time.Time{}, time.Time{}},
+		{"W3SVC1-web01.log", false, time.Time{}, time.Time{}},
+		{"u_ex171331.log", false, time.Time{}, time.Time{}},
+	}
+	for _, tc := range tests {
+		from, to, ok := fileFrame(tc.name)
+		if ok != tc.ok || (ok && (!from.Equal(tc.from) || !to.Equal(tc.to))) {
+			t.Errorf("%s: expecting %v %v-%v, got %v %v-%v", tc.name, tc.ok, tc.from, tc.to, ok, from, to)
+		}
+	}
+}
+
+const peekLog = "#Software: Microsoft Internet Information Services 10.0\r\n" +
+	"#Version: 1.0\r\n" +
+	"#Date: 2017-01-31 09:08:40\r\n" +
+	"#Fields: date time cs-uri-stem sc-status\r\n" +
+	"2017-01-31 09:08:40 /myapp/ 500\r\n" +
+	"2017-01-31 10:35:03 /myapp/ 404\r\n"
+
+func TestPeekFrame(t *testing.T) {
+	from0 := time.Date(2017, 1, 31, 9, 8, 40, 0, time.UTC)
+	to0 := time.Date(2017, 1, 31, 10, 35, 4, 0, time.UTC)
+
+	// Seekable reader gives the last record
+	from, to, r, ok := peekFrame(bytes.NewReader([]byte(peekLog)))
+	if !ok || !from.Equal(from0) || !to.Equal(to0) {
+		t.Errorf("Expecting %v-%v, got %v %v-%v", from0, to0, ok, from, to)
+	}
+	if b, _ := ioutil.ReadAll(r); string(b) != peekLog {
+		t.Errorf("Expecting the whole file to be read after peeking")
+	}
+
+	// Only the #Date directive is available in a stream
+	from, to, r, ok = peekFrame(struct{ io.Reader }{strings.NewReader(peekLog)})
+	if !ok || !from.Equal(from0) || !to.IsZero() {
+		t.Errorf("Expecting %v-, got %v %v-%v", from0, ok, from, to)
+	}
+	if b, _ := ioutil.ReadAll(r); string(b) != peekLog {
+		t.Errorf("Expecting the whole file to be read after peeking")
+	}
+
+	if _, _, _, ok = peekFrame(strings.NewReader("some application log\n")); ok {
+		t.Errorf("Expecting a file without directives to be rejected")
+	}
+}
+
+// osItem is a logItem reading a file on disk
+type osItem struct {
+	name string
+	f    *os.File
+}
+
+func (o *osItem) Name() string                  { return filepath.Base(o.name) }
+func (o *osItem) Source() (file, member string) { return o.name, "" }
+func (o *osItem) Reader() (r io.Reader, err error) {
+	o.f, err = os.Open(o.name)
+	return o.f, err
+}
+func (o *osItem) Close() error { return o.f.Close() }
+
+func TestFileFilterReopens(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "u_extend1.log")
+	os.WriteFile(name, []byte(peekLog), 0644)
+	item := &osItem{name: name}
+
+	a := NewApplication()
+	in, out := make(chan interface{}, 1), make(chan interface{}, 1)
+	in <- item
+	close(in)
+	a.FileFilterOperator()(in, out)
+	file := (<-out).(*logFile)
+
+	// Peeked files without date in their name aren't kept open
+	if _, err := item.f.Read(make([]byte, 1)); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Expecting the file to be closed after peeking, got %v", err)
+	}
+	r, err := file.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(r); string(b) != peekLog {
+		t.Errorf("Expecting the whole file to be read after reopening it")
+	}
+	file.close()
+}
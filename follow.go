@@ -0,0 +1,259 @@
+package iislog
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simulot/golib/pipeline"
+	"github.com/simulot/iislog/iis"
+)
+
+// followPoll is the delay between two checks for new lines
+var followPoll = time.Second
+
+// follower is a reader that follows the current log file of a folder, like tail -f.
+// When IIS rolls over to a new file, the reader ends, and next continues with
+// the new file, so each file is parsed with its own name, lines and offsets.
+type follower struct {
+	dir    string
+	name   string       // current file
+	file   *os.File     // current file
+	start  iis.Position // Position of the parser at the start of the reader
+	rolled string       // File IIS rolled over to
+	poll   time.Duration
+	ctx    context.Context // Stops following when done
+}
+
+// newFollower starts following the most recent log file of the folder, until the context is done.
+// The file is read after the line given by sent, or after its last complete line when sent is nil.
+func newFollower(ctx context.Context, dir string, sent func(file string) int) (*follower, error) {
+	f := &follower{
+		dir:   dir,
+		poll:  followPoll,
+		ctx:   ctx,
+		start: iis.Position{Line: 1},
+	}
+	name, err := f.current()
+	if err != nil {
+		return nil, err
+	}
+	if name != "" {
+		after := -1
+		if sent != nil {
+			after = sent(name)
+		}
+		if err = f.skip(name, after); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// current returns the log file modified most recently, "" if none
+func (f *follower) current() (string, error) {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return "", err
+	}
+	name, modTime := "", time.Time{}
+	for _, e := range entries {
+		if e.IsDir() || !isLogFileName(e.Name()) {
+			continue
+		}
+		file := filepath.Join(f.dir, e.Name())
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if t := info.ModTime(); t.After(modTime) || (t.Equal(modTime) && file > name) {
+			name, modTime = file, t
+		}
+	}
+	return name, nil
+}
+
+// skip opens the file, and positions the reader after the given number of lines,
+// or after its last complete line when lines is negative, with the header directives
+// in effect there
+func (f *follower) skip(name string, lines int) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	header := []string{}
+	offset, skipped := int64(0), 0
+	r := bufio.NewReader(file)
+	for lines < 0 || skipped < lines {
+		s, err := r.ReadString('\n')
+		if err != nil {
+			break // Partial line is read again later
+		}
+		offset += int64(len(s))
+		skipped++
+		if strings.HasPrefix(s, "#") {
+			header = append(header, s)
+		}
+	}
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+
+	// Directives in effect at that line
+	p := iis.NewLogParser(strings.NewReader(strings.Join(header, "")))
+	for range p.Records(nil) {
+	}
+	f.start = p.Position()
+	f.start.Line, f.start.Offset = skipped+1, offset
+	f.name, f.file = name, file
+	return nil
+}
+
+// Read implements io.Reader. It waits for new lines, and ends when IIS
+// has rolled over to a new file.
+func (f *follower) Read(p []byte) (int, error) {
+	for {
+		if f.file != nil {
+			n, err := f.file.Read(p)
+			if n > 0 || (err != nil && err != io.EOF) {
+				return n, err
+			}
+		}
+
+		// End of the current file, has IIS created a new one?
+		next, err := f.current()
+		if err != nil {
+			return 0, err
+		}
+		if next != "" && next != f.name {
+			if f.file != nil {
+				// Last lines written before the switch
+				if n, _ := f.file.Read(p); n > 0 {
+					return n, nil
+				}
+			}
+			f.rolled = next
+			return 0, io.EOF
+		}
+
+		select {
+		case <-f.ctx.Done():
+			return 0, io.EOF
+		case <-time.After(f.poll):
+		}
+	}
+}
+
+// next continues with the file IIS rolled over to. It returns false when
+// following has stopped.
+func (f *follower) next() (bool, error) {
+	if f.ctx.Err() != nil || f.rolled == "" {
+		return false, nil
+	}
+	if f.file != nil {
+		f.file.Close()
+	}
+	file, err := os.Open(f.rolled)
+	if err != nil {
+		f.file = nil
+		return false, err
+	}
+	f.name, f.file, f.rolled = f.rolled, file, ""
+	f.start = iis.Position{Line: 1}
+	return true, nil
+}
+
+// Close closes the current file
+func (f *follower) Close() error {
+	if f.file != nil {
+		return f.file.Close()
+	}
+	return nil
+}
+
+// parseFollowed sends records of r, a reader starting at the position start of a log
+func (a *Application) parseFollowed(r io.Reader, file, member string, start iis.Position, filter iis.RecordFilter, out chan interface{}) {
+	p := iis.NewLogParser(r)
+	p.SetSource(file, member)
+	p.Resume(start)
+	p.SetErrorHandler(a.errs.add)
+	for rec := range p.ParseContext(a.context(), filter) {
+		out <- rec
+	}
+}
+
+// followFolder sends new records of the followed folder, until following stops.
+// Each file has its own parser, for its name, lines and offsets.
+func (a *Application) followFolder(f *follower, filter iis.RecordFilter, out chan interface{}) {
+	defer f.Close()
+	for {
+		a.parseFollowed(f, f.name, "", f.start, filter, out)
+		ok, err := f.next()
+		if err != nil {
+			a.errs.add(&iis.ParseError{File: f.rolled, Err: err})
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+// FollowOperator creates an operator that follows log files of folders
+// and emits new records as they are written
+func (a *Application) FollowOperator() pipeline.Operator {
+	filter := a.MakeLogRecordFilter()
+	return func(in, out chan interface{}) {
+		// Shipping resumes after the last line sent
+		var sent func(string) int
+		if a.checkpoint != "" && a.sinkFormat() {
+			c, err := loadCheckpoint(a.checkpoint)
+			if err != nil {
+				a.errs.add(&iis.ParseError{File: a.checkpoint, Err: err})
+				for range in {
+				}
+				return
+			}
+			sent = c.line
+		}
+		wg := sync.WaitGroup{}
+		for i := range in {
+			switch source := i.(type) {
+			case string:
+				f, err := newFollower(a.context(), source, sent)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					continue
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					a.followFolder(f, filter, out)
+				}()
+			case logItem:
+				// A stream like the standard input is parsed until its end
+				r, err := source.Reader()
+				if err != nil {
+					a.errs.report(source, err)
+					continue
+				}
+				file, member := source.Source()
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					defer source.Close()
+					a.parseFollowed(r, file, member, iis.Position{Line: 1}, filter, out)
+				}()
+			default:
+				panic("Expecting string in pipeline.Operator FollowOperator")
+			}
+		}
+		wg.Wait()
+	}
+}
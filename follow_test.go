@@ -0,0 +1,261 @@
+package iislog
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/simulot/iislog/iis"
+)
+
+const followHeader = "#Software: Microsoft Internet Information Services 10.0\r\n" +
+	"#Date: 2017-01-31 09:00:00\r\n" +
+	"#Fields: date time cs-uri-stem sc-status\r\n"
+
+// appendLog appends text to the log file
+func appendLog(t *testing.T, name, text string) {
+	t.Helper()
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = f.WriteString(text); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startFollow follows the folder, and returns the channel of its new records
+func startFollow(t *testing.T, dir string) chan interface{} {
+	t.Helper()
+	poll := followPoll
+	followPoll = 10 * time.Millisecond
+	t.Cleanup(func() { followPoll = poll })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a := NewApplication()
+	a.ctx = ctx
+	a.errs = newParseErrors(false, cancel, nil)
+	f, err := newFollower(ctx, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(chan interface{})
+	done := make(chan bool)
+	go func() {
+		a.followFolder(f, nil, out)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		for range out {
+		}
+	})
+	go func() {
+		<-done
+		close(out)
+	}()
+	return out
+}
+
+// nextRecord waits for the next record
+func nextRecord(t *testing.T, out chan interface{}) *iis.LogRecord {
+	t.Helper()
+	select {
+	case i := <-out:
+		return i.(*iis.LogRecord)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expecting a record")
+		return nil
+	}
+}
+
+func TestFollowSource(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "u_ex17013109.log")
+	before := followHeader + "2017-01-31 09:00:01 /old 200\r\n"
+	appendLog(t, first, before)
+
+	out := startFollow(t, dir)
+	line := "2017-01-31 09:59:59 /a 200\r\n"
+	appendLog(t, first, line)
+	r := nextRecord(t, out)
+	if r.File != first || r.Line != 5 || r.Offset != int64(len(before)) || r.URI != "/a" {
+		t.Errorf("Expecting /a at %s:5 offset %d, got %s at %s:%d offset %d", first, len(before), r.URI, r.File, r.Line, r.Offset)
+	}
+
+	// IIS rolls over to a new file
+	time.Sleep(20 * time.Millisecond) // Newer modification time
+	second := filepath.Join(dir, "u_ex17013110.log")
+	appendLog(t, second, followHeader+"2017-01-31 10:00:00 /b 200\r\n")
+	r = nextRecord(t, out)
+	if r.File != second || r.Line != 4 || r.Offset != int64(len(followHeader)) || r.URI != "/b" {
+		t.Errorf("Expecting /b at %s:4 offset %d, got %s at %s:%d offset %d", second, len(followHeader), r.URI, r.File, r.Line, r.Offset)
+	}
+}
+
+func TestFollowRollover(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "u_ex17013109.log")
+	appendLog(t, first, followHeader+"2017-01-31 09:00:01 /old 200\r\n")
+	out := startFollow(t, dir)
+
+	// A partial line is reported once complete
+	appendLog(t, first, "2017-01-31 09:00:02 /a")
+	time.Sleep(50 * time.Millisecond)
+	appendLog(t, first, " 200\r\n2017-01-31 09:00:03 /b 404\r\n")
+	time.Sleep(50 * time.Millisecond)
+
+	// Last line of the file, then IIS rolls over to a new file, with other fields
+	appendLog(t, first, "2017-01-31 09:59:59 /c 200\r\n")
+	second := filepath.Join(dir, "u_ex17013110.log")
+	appendLog(t, second, "#Software: Microsoft Internet Information Services 10.0\r\n"+
+		"#Date: 2017-01-31 10:00:00\r\n"+
+		"#Fields: date time sc-status cs-uri-stem\r\n"+
+		"2017-01-31 10:00:00 500 /d\r\n")
+	time.Sleep(50 * time.Millisecond)
+	appendLog(t, second, "2017-01-31 10:00:01 200 /e\r\n")
+
+	expected := []struct {
+		file   string
+		uri    string
+		status int
+	}{
+		{first, "/a", 200},
+		{first, "/b", 404},
+		{first, "/c", 200},
+		{second, "/d", 500},
+		{second, "/e", 200},
+	}
+	for _, e := range expected {
+		r := nextRecord(t, out)
+		if r.File != e.file || r.URI != e.uri || r.Status != e.status {
+			t.Errorf("Expecting %s %d from %s, got %s %d from %s", e.uri, e.status, e.file, r.URI, r.Status, r.File)
+		}
+	}
+	select {
+	case i := <-out:
+		t.Errorf("Unexpected record %s", i.(*iis.LogRecord).Raw)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestFollowCheckpoint(t *testing.T) {
+	poll := followPoll
+	followPoll = 10 * time.Millisecond
+	defer func() { followPoll = poll }()
+
+	var (
+		mu     sync.Mutex
+		pushed []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := struct{ Streams []lokiStream }{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, s := range body.Streams {
+			for _, v := range s.Values {
+				line := map[string]interface{}{}
+				json.Unmarshal([]byte(v[1]), &line)
+				pushed = append(pushed, line["cs-uri-stem"].(string))
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	log := filepath.Join(dir, "u_ex17013109.log")
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint.json")
+
+	// tail runs until count lines have been pushed
+	tail := func(count int, write func()) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		a := NewApplication()
+		a.command = tailCommand
+		a.format = "loki"
+		a.output = srv.URL
+		a.checkpoint = checkpoint
+		a.files = []string{dir}
+		a.ctx = ctx
+		done := make(chan error)
+		go func() { done <- a.Run() }()
+		write()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			mu.Lock()
+			n := len(pushed)
+			mu.Unlock()
+			if n >= count {
+				break
+			}
+		}
+		cancel()
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	appendLog(t, log, followHeader+"2017-01-31 09:00:01 /a 200\r\n")
+	tail(2, func() { appendLog(t, log, "2017-01-31 09:00:02 /b 200\r\n") })
+
+	// Lines written while stopped, and after the restart
+	appendLog(t, log, "2017-01-31 09:00:03 /c 200\r\n")
+	tail(4, func() { appendLog(t, log, "2017-01-31 09:00:04 /d 200\r\n") })
+
+	c, err := loadCheckpoint(checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line := c.line(log); line != 7 {
+		t.Errorf("Expecting line 7 in the checkpoint, got %d", line)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Join(pushed, " "); got != "/a /b /c /d" {
+		t.Errorf("Expecting /a /b /c /d pushed once, got %s", got)
+	}
+}
+
+func TestFollowerCurrent(t *testing.T) {
+	tests := []struct {
+		files    []string // From the oldest to the most recent
+		expected string
+	}{
+		{[]string{"u_ex170130.log", "u_ex170131.log"}, "u_ex170131.log"},
+		{[]string{"ex17013108.log", "ex17013109.log", "notes.txt"}, "ex17013109.log"},
+		{[]string{"u_ex1701.log", "u_extend2.log", "u_ex170131.log.bak"}, "u_extend2.log"},
+		{[]string{"readme.log"}, ""},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		for i, name := range tt.files {
+			file := filepath.Join(dir, name)
+			os.WriteFile(file, nil, 0644)
+			mtime := time.Date(2017, 1, 31, 9, i, 0, 0, time.UTC)
+			os.Chtimes(file, mtime, mtime)
+		}
+		f := &follower{dir: dir}
+		name, err := f.current()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.expected != "" {
+			tt.expected = filepath.Join(dir, tt.expected)
+		}
+		if name != tt.expected {
+			t.Errorf("%v: expecting %q, got %q", tt.files, tt.expected, name)
+		}
+	}
+}
@@ -2,7 +2,12 @@ package iis
 
 import (
 	"bufio"
+	"context"
+	"fmt"
 	"io"
+	"iter"
+	"net"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -10,25 +15,75 @@ import (
 
 // LogParser is a parser for IISlogs
 type LogParser struct {
-	r      *bufio.Reader
-	fields []string
+	r       *bufio.Reader
+	fields  []string
+	onError func(*ParseError) bool // Called for lines that can't be parsed
+	file    string                 // Source of records
+	member  string
+	date    time.Time // #Date directive in effect
+	line    int       // Current line number
+	offset  int64     // Offset of the current line
+	next    int64     // Offset of the next line
+}
+
+// Position is the state of the parser at a line, to resume the parsing there later
+type Position struct {
+	Line   int       // Line number
+	Offset int64     // Offset of the line
+	Date   time.Time // #Date directive in effect
+	Fields []string  // #Fields directive in effect
+}
+
+// Position gives the state of the parser at the line being parsed. While iterating
+// on Records, it's the position of the line of the current record.
+func (l *LogParser) Position() Position {
+	return Position{Line: l.line, Offset: l.offset, Date: l.date, Fields: l.fields}
+}
+
+// Resume sets the state of a parser which reader starts at the line of pos, so the
+// parsing continues as it was at pos.
+func (l *LogParser) Resume(pos Position) {
+	l.line, l.next, l.date, l.fields = pos.Line-1, pos.Offset, pos.Date, pos.Fields
 }
 
 // LogRecord is an individual log line
 type LogRecord struct {
-	Raw        string            // Raw log line
-	DateTime   time.Time         // Log event time UTC
-	User       string            // Identified user
-	Server     string            // Server's IP
-	Site       string            // Begining of the url
-	URI        string            // URI
-	Query      string            // Request parameters
-	Status     int               // Main status code
-	SubStatus  int               // Sub status code
-	TimeTaken  time.Duration     // Request time taken
-	Other      map[string]string // Other extracted fields
-	filter     RecordFilter      // Inject filter logic
-	date, hour string            // temporary storage for reading date and time from separate fields
+	Raw           string              // Raw log line
+	DateTime      time.Time           // Log event time UTC
+	SiteName      string              // Service name and instance number (W3SVC1)
+	ComputerName  string              // Server's name
+	User          string              // Identified user
+	Server        net.IP              // Server's IP
+	Port          int                 // Server's port
+	Client        net.IP              // Client's IP
+	Method        string              // Request verb (GET, POST...)
+	Site          string              // Begining of the url
+	URI           string              // URI
+	Query         string              // Request parameters
+	ASPLine       int                 // Classic ASP error line, appended by ASP to the query
+	ASPErrorCode  string              // Classic ASP error HRESULT, like 800a0046
+	ASPError      string              // Classic ASP error message
+	Version       string              // Protocol version (HTTP/1.1)
+	Host          string              // Host header
+	UserAgent     string              // User agent, with + decoded as spaces
+	Referer       string              // Referring page
+	Cookie        string              // Cookies sent by the client, with + decoded as spaces
+	Status        int                 // Main status code
+	SubStatus     int                 // Sub status code
+	Win32Status   int                 // Windows status code
+	BytesSent     int64               // Bytes sent by the server
+	BytesReceived int64               // Bytes received by the server
+	TimeTaken     time.Duration       // Request time taken
+	Other         map[string]string   // Other extracted fields
+	Fields        []string            // Fields names as given by the log, in log order
+	File          string              // Log file the record comes from
+	Member        string              // File in an archive the record comes from, if any
+	Offset        int64               // Offset of the line in the file
+	Line          int                 // Line number in the file, starting at 1
+	params        map[string][]string // Query parameters, parsed when needed
+	filter        RecordFilter        // Inject filter logic
+	err           error               // First field that can't be parsed
+	date, hour    string              // temporary storage for reading date and time from separate fields
 }
 
 // NewLogParser creates an instance of IIS LogParser
@@ -38,6 +93,41 @@ func NewLogParser(r io.Reader) *LogParser {
 	}
 }
 
+// ParseError is a line of a log that can't be parsed
+type ParseError struct {
+	File   string // Log file, given by the caller of the parser
+	Member string // File in an archive, given by the caller of the parser
+	Line   int    // Line number, starting at 1. 0 when the file can't be read
+	Text   string // Line content
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	name := e.File
+	if e.Member != "" {
+		name += "[" + e.Member + "]"
+	}
+	if e.Line > 0 {
+		name += ":" + strconv.Itoa(e.Line)
+	}
+	return name + ": " + e.Err.Error()
+}
+
+func (e *ParseError) Unwrap() error { return e.Err }
+
+// SetSource sets the file, and the file in an archive if any, given to records
+// and parse errors
+func (l *LogParser) SetSource(file, member string) {
+	l.file, l.member = file, member
+}
+
+// SetErrorHandler sets the function called for each line that can't be parsed.
+// Such lines are skipped, and the parsing stops when the handler returns false.
+// By default, they are silently skipped.
+func (l *LogParser) SetErrorHandler(h func(*ParseError) bool) {
+	l.onError = h
+}
+
 const (
 	fieldsPrefix = "#Fields: "
 	datePrefix   = "#Date: "
@@ -46,17 +136,58 @@ const (
 
 // Parse the log and emits log records on the out chan
 func (l *LogParser) Parse(filter RecordFilter) chan *LogRecord {
+	return l.ParseContext(context.Background(), filter)
+}
+
+// ParseContext parses the log and emits log records on the out chan, until the
+// end of the log or the context is done. The consumer can stop reading the channel
+// once it has cancelled the context.
+func (l *LogParser) ParseContext(ctx context.Context, filter RecordFilter) chan *LogRecord {
 	out := make(chan *LogRecord)
-	go l.doParse(out, filter)
+	go func() {
+		if filter == nil {
+			filter = &NoFilter{}
+		}
+		l.doParse(ctx, func(r *LogRecord) bool {
+			select {
+			case out <- r:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}, filter)
+		close(out)
+	}()
 	return out
 }
 
-// doParse does the actual work of parsing the log file
-func (l *LogParser) doParse(out chan *LogRecord, filter RecordFilter) {
-	logDate := time.Time{}
+// Records gives an iterator on log records, without goroutine. Use iter.Pull to
+// get records one by one.
+func (l *LogParser) Records(filter RecordFilter) iter.Seq[*LogRecord] {
+	if filter == nil {
+		filter = &NoFilter{}
+	}
+	return func(yield func(*LogRecord) bool) {
+		l.doParse(context.Background(), yield, filter)
+	}
+}
+
+// doParse does the actual work of parsing the log file, until yield returns false
+// or the context is done
+func (l *LogParser) doParse(ctx context.Context, yield func(*LogRecord) bool, filter RecordFilter) {
 	s, err := l.r.ReadString('\n')
 
-	for err == nil || (err == io.EOF && len(s) > 0) {
+	// reject reports the current line, and returns false to stop the parsing
+	reject := func(err error) bool {
+		if l.onError == nil {
+			return true
+		}
+		return l.onError(&ParseError{File: l.file, Member: l.member, Line: l.line, Text: s, Err: err})
+	}
+
+	for (err == nil || (err == io.EOF && len(s) > 0)) && ctx.Err() == nil {
+		l.line++
+		l.offset, l.next = l.next, l.next+int64(len(s))
 		for i := len(s) - 1; i > 0 && (s[i] == '\r' || s[i] == '\n'); i-- {
 			s = s[:i]
 		}
@@ -64,8 +195,11 @@ func (l *LogParser) doParse(out chan *LogRecord, filter RecordFilter) {
 
 		// #Date: get log date
 		case strings.HasPrefix(s, datePrefix):
-			s = s[len(datePrefix):]
-			logDate, err = time.ParseInLocation(tsFormat, s, time.UTC)
+			var dateErr error
+			l.date, dateErr = time.ParseInLocation(tsFormat, s[len(datePrefix):], time.UTC)
+			if dateErr != nil && !reject(fmt.Errorf("#Date: %w", dateErr)) {
+				return
+			}
 
 		// #Fields : get fields definition, may have changed
 		case strings.HasPrefix(s, fieldsPrefix):
@@ -90,8 +224,10 @@ func (l *LogParser) doParse(out chan *LogRecord, filter RecordFilter) {
 			{
 				// Do parsing work only if the log date is in time frame and if
 				// a full text pattern is recognized
-				if filter.CheckDate(logDate) && filter.CheckFullLine(&s) {
+				if filter.CheckDate(l.date) && filter.CheckFullLine(&s) {
 					r := NewLogRecord(s, filter)
+					r.Fields = l.fields
+					r.File, r.Member, r.Offset, r.Line = l.file, l.member, l.offset, l.line
 					fieldIndex := 0
 					mark := 0
 					selected := true
@@ -102,6 +238,12 @@ func (l *LogParser) doParse(out chan *LogRecord, filter RecordFilter) {
 							}
 							field := s[mark:i]
 							mark = i + 1
+							if fieldIndex >= len(l.fields) {
+								// More values than fields
+								fieldIndex = strings.Count(s, " ") + 1
+								r.err = fmt.Errorf("%d values for %d fields", fieldIndex, len(l.fields))
+								break
+							}
 							if !r.Set(l.fields[fieldIndex], field) {
 								// the record parsing is abandonned
 								// as soon as a field is rejected by the filter
@@ -111,15 +253,28 @@ func (l *LogParser) doParse(out chan *LogRecord, filter RecordFilter) {
 							fieldIndex++
 						}
 					}
+					if selected && r.err == nil && fieldIndex < len(l.fields) {
+						r.err = fmt.Errorf("%d values for %d fields", fieldIndex, len(l.fields))
+					}
+					if r.err != nil {
+						if !reject(r.err) {
+							return
+						}
+						selected = false
+					}
 					if selected {
-						out <- r
+						if c, ok := filter.(RecordChecker); ok {
+							selected = c.CheckRecord(r)
+						}
+					}
+					if selected && !yield(r) {
+						return
 					}
 				}
 			}
 		}
 		s, err = l.r.ReadString('\n')
 	}
-	close(out)
 }
 
 // NewLogRecord creates a new instance of log record
@@ -140,6 +295,11 @@ func NewLogRecord(raw string, filter RecordFilter) *LogRecord {
 func (r *LogRecord) Set(field, value string) bool {
 	var err error
 	var i int
+	defer func() {
+		if err != nil && r.err == nil {
+			r.err = fmt.Errorf("%s: %w", field, err)
+		}
+	}()
 
 	switch field {
 	case "DateTime":
@@ -157,27 +317,79 @@ func (r *LogRecord) Set(field, value string) bool {
 			return r.Set("DateTime", "")
 		}
 		return true
-	case "s-ip":
-		r.Server = value
+	case "s-sitename":
+		r.SiteName = value
+		return r.filter.CheckField(field, value)
+	case "s-computername":
+		r.ComputerName = value
 		return r.filter.CheckField(field, value)
+	case "s-ip":
+		r.Server = net.ParseIP(value)
+		return r.filter.CheckField(field, r.Server)
+	case "s-port":
+		r.Port, err = atoi(value)
+		return r.filter.CheckField(field, r.Port)
+	case "c-ip":
+		r.Client = net.ParseIP(value)
+		return r.filter.CheckField(field, r.Client)
 	case "cs-username":
 		r.User = value
 		return r.filter.CheckField(field, value)
+	case "cs-method":
+		r.Method = value
+		return r.filter.CheckField(field, value)
 	case "cs-uri-stem":
 		r.URI = value
+		if value == "" {
+			// IIS writes - for missing values, an empty one comes from a malformed line
+			err = fmt.Errorf("empty value")
+			return true
+		}
 		if i := strings.Index(value[1:], "/"); i >= 0 {
 			r.Site = value[0 : i+1]
 		}
 		return r.filter.CheckField(field, value)
 	case "cs-uri-query":
 		r.Query = value
+		if !r.filter.CheckField(field, value) {
+			return false
+		}
+		if r.parseASPError() {
+			return r.filter.CheckField("asp-line", r.ASPLine) &&
+				r.filter.CheckField("asp-error-code", r.ASPErrorCode) &&
+				r.filter.CheckField("asp-error-message", r.ASPError)
+		}
+		return true
+	case "cs-version":
+		r.Version = value
 		return r.filter.CheckField(field, value)
+	case "cs-host":
+		r.Host = value
+		return r.filter.CheckField(field, value)
+	case "cs(User-Agent)":
+		r.UserAgent = strings.Replace(value, "+", " ", -1)
+		return r.filter.CheckField(field, r.UserAgent)
+	case "cs(Referer)":
+		r.Referer = value
+		return r.filter.CheckField(field, value)
+	case "cs(Cookie)":
+		r.Cookie = strings.Replace(value, "+", " ", -1)
+		return r.filter.CheckField(field, r.Cookie)
 	case "sc-status":
 		r.Status, err = strconv.Atoi(value)
 		return r.filter.CheckError(r.Status, r.SubStatus)
 	case "sc-substatus":
 		r.SubStatus, err = strconv.Atoi(value)
 		return r.filter.CheckError(r.Status, r.SubStatus)
+	case "sc-win32-status":
+		r.Win32Status, err = atoi(value)
+		return r.filter.CheckField(field, r.Win32Status)
+	case "sc-bytes":
+		r.BytesSent, err = atoi64(value)
+		return r.filter.CheckField(field, r.BytesSent)
+	case "cs-bytes":
+		r.BytesReceived, err = atoi64(value)
+		return r.filter.CheckField(field, r.BytesReceived)
 	case "time-taken":
 		i, err = strconv.Atoi(value)
 		if err == nil {
@@ -191,6 +403,28 @@ func (r *LogRecord) Set(field, value string) bool {
 	}
 }
 
+// KnownFields lists field names known by Get: W3C fields, then derived ones.
+// Any other name is looked up in Other.
+var KnownFields = []string{
+	"date", "time", "s-sitename", "s-computername", "s-ip", "s-port", "c-ip",
+	"cs-username", "cs-method", "cs-uri-stem", "cs-uri-query", "cs-version", "cs-host",
+	"cs(User-Agent)", "cs(Referer)", "cs(Cookie)",
+	"sc-status", "sc-substatus", "sc-win32-status", "sc-bytes", "cs-bytes", "time-taken",
+	"DateTime", "hour", "status", "status-label", "site",
+	"asp-line", "asp-error-code", "asp-error-message",
+	"source-file", "source-member", "source-offset", "source-line",
+}
+
+// IsKnownField returns true when the field is one of KnownFields
+func IsKnownField(field string) bool {
+	for _, f := range KnownFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
 // Get log record value per field name
 func (r *LogRecord) Get(field string) interface{} {
 	switch field {
@@ -200,18 +434,60 @@ func (r *LogRecord) Get(field string) interface{} {
 		return r.DateTime.Format("2006-01-02")
 	case "time":
 		return r.DateTime.Format("15:04:05")
+	case "hour":
+		return r.DateTime.Format("2006-01-02 15:00")
+	case "s-sitename":
+		return r.SiteName
+	case "s-computername":
+		return r.ComputerName
 	case "s-ip":
 		return r.Server
+	case "s-port":
+		return r.Port
+	case "c-ip":
+		return r.Client
 	case "cs-username":
 		return r.User
+	case "cs-method":
+		return r.Method
 	case "cs-uri-stem":
 		return r.URI
 	case "cs-uri-query":
 		return r.Query
+	case "asp-line":
+		return r.ASPLine
+	case "asp-error-code":
+		return r.ASPErrorCode
+	case "asp-error-message":
+		return r.ASPError
+	case "source-file":
+		return r.File
+	case "source-member":
+		return r.Member
+	case "source-offset":
+		return r.Offset
+	case "source-line":
+		return r.Line
+	case "cs-version":
+		return r.Version
+	case "cs-host":
+		return r.Host
+	case "cs(User-Agent)":
+		return r.UserAgent
+	case "cs(Referer)":
+		return r.Referer
+	case "cs(Cookie)":
+		return r.Cookie
 	case "sc-status":
 		return r.Status
 	case "sc-substatus":
 		return r.SubStatus
+	case "sc-win32-status":
+		return r.Win32Status
+	case "sc-bytes":
+		return r.BytesSent
+	case "cs-bytes":
+		return r.BytesReceived
 	case "time-taken":
 		return r.TimeTaken //int(r.TimeTaken / time.Microsecond)
 	case "status":
@@ -221,10 +497,105 @@ func (r *LogRecord) Get(field string) interface{} {
 	case "site":
 		return r.Site
 	default:
+		if strings.HasPrefix(field, "param(") && strings.HasSuffix(field, ")") {
+			return r.Param(field[len("param(") : len(field)-1])
+		}
 		return r.Other[field]
 	}
 }
 
+// parseASPError extracts details added by Classic ASP to the query when a script fails:
+// query|line|hresult|message, where message has spaces replaced by underscores.
+// It returns true when the query has such details.
+func (r *LogRecord) parseASPError() bool {
+	i := strings.IndexByte(r.Query, '|')
+	if i < 0 {
+		return false
+	}
+	parts := strings.SplitN(r.Query[i+1:], "|", 3)
+	if len(parts) != 3 {
+		return false
+	}
+	line, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false
+	}
+	r.ASPLine = line
+	r.ASPErrorCode = parts[1]
+	r.ASPError = strings.Replace(parts[2], "_", " ", -1)
+	return true
+}
+
+// RequestQuery returns the query sent by the client, without Classic ASP error details
+func (r *LogRecord) RequestQuery() string {
+	if r.ASPErrorCode != "" {
+		if q := r.Query[:strings.IndexByte(r.Query, '|')]; q != "" {
+			return q
+		}
+		return "-"
+	}
+	return r.Query
+}
+
+// Params returns the decoded parameters of the query
+func (r *LogRecord) Params() map[string][]string {
+	if r.params == nil {
+		r.params = ParseQuery(r.RequestQuery())
+	}
+	return r.params
+}
+
+// Param returns the first value of a query parameter
+func (r *LogRecord) Param(name string) string {
+	if v := r.Params()[name]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// ParseQuery splits a query into decoded parameters.
+// Unlike url.ParseQuery, it accepts malformed queries, keeping what can't be decoded as is.
+func ParseQuery(query string) map[string][]string {
+	params := map[string][]string{}
+	if query == "-" {
+		return params
+	}
+	for _, p := range strings.Split(query, "&") {
+		if len(p) == 0 {
+			continue
+		}
+		value := ""
+		if i := strings.IndexByte(p, '='); i >= 0 {
+			p, value = p[:i], p[i+1:]
+		}
+		params[queryUnescape(p)] = append(params[queryUnescape(p)], queryUnescape(value))
+	}
+	return params
+}
+
+func queryUnescape(s string) string {
+	if u, err := url.QueryUnescape(s); err == nil {
+		return u
+	}
+	return s
+}
+
+// atoi converts a numerical field, IIS uses - for empty values
+func atoi(value string) (int, error) {
+	if value == "-" {
+		return 0, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// atoi64 converts a numerical field that may exceed 32 bits, like byte counters
+func atoi64(value string) (int64, error) {
+	if value == "-" {
+		return 0, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
 // IsAnError returns true when status denotes a protocol error
 func (r *LogRecord) IsAnError() bool {
 	return r.Status >= 400 && r.Status < 600
@@ -370,6 +741,12 @@ type RecordFilter interface {
 	CheckError(status, substatus int) bool
 }
 
+// RecordChecker can be implemented by a RecordFilter that needs the whole record
+// to take its decision. CheckRecord is called once all fields have been read.
+type RecordChecker interface {
+	CheckRecord(r *LogRecord) bool
+}
+
 // NoFilter is a filter that filter nothing
 type NoFilter struct{}
 
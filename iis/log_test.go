@@ -0,0 +1,216 @@
+package iis
+
+import (
+	"context"
+	"iter"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const extendedLog = `#Software: Microsoft Internet Information Services 10.0
+#Version: 1.0
+#Date: 2017-01-31 09:08:40
+#Fields: date time s-sitename s-computername s-ip cs-method cs-uri-stem cs-uri-query s-port cs-username c-ip cs-version cs(User-Agent) cs(Cookie) cs(Referer) cs-host sc-status sc-substatus sc-win32-status sc-bytes cs-bytes time-taken
+2017-01-31 09:08:40 W3SVC1 WEB01 10.30.136.200 POST /myapp/default.asp id=3 443 DOMAIN\user 192.168.1.12 HTTP/1.1 Mozilla/5.0+(Windows+NT+10.0) ASPSESSIONID=ABC;+lang=fr https://intranet/myapp/ intranet 500 0 64 5120 4294967296 2246
+`
+
+func TestExtendedFields(t *testing.T) {
+	p := NewLogParser(strings.NewReader(extendedLog))
+	var records []*LogRecord
+	for r := range p.Parse(nil) {
+		records = append(records, r)
+	}
+	if len(records) != 1 {
+		t.Fatalf("Expecting 1 record, got %d", len(records))
+	}
+	r := records[0]
+
+	checks := []struct {
+		field string
+		value interface{}
+	}{
+		{"s-sitename", "W3SVC1"},
+		{"s-computername", "WEB01"},
+		{"cs-method", "POST"},
+		{"cs-uri-stem", "/myapp/default.asp"},
+		{"cs-uri-query", "id=3"},
+		{"s-port", 443},
+		{"cs-username", `DOMAIN\user`},
+		{"cs-version", "HTTP/1.1"},
+		{"cs(User-Agent)", "Mozilla/5.0 (Windows NT 10.0)"},
+		{"cs(Cookie)", "ASPSESSIONID=ABC; lang=fr"},
+		{"cs(Referer)", "https://intranet/myapp/"},
+		{"cs-host", "intranet"},
+		{"sc-status", 500},
+		{"sc-substatus", 0},
+		{"sc-win32-status", 64},
+		{"sc-bytes", int64(5120)},
+		{"cs-bytes", int64(4294967296)},
+		{"time-taken", 2246 * time.Millisecond},
+		{"site", "/myapp"},
+	}
+	for _, c := range checks {
+		if v := r.Get(c.field); v != c.value {
+			t.Errorf("Field %s: expecting %#v, got %#v", c.field, c.value, v)
+		}
+	}
+	if !r.Server.Equal(net.ParseIP("10.30.136.200")) {
+		t.Errorf("Expecting s-ip 10.30.136.200, got %v", r.Server)
+	}
+	if !r.Client.Equal(net.ParseIP("192.168.1.12")) {
+		t.Errorf("Expecting c-ip 192.168.1.12, got %v", r.Client)
+	}
+	if len(r.Other) != 0 {
+		t.Errorf("Expecting no untyped field, got %v", r.Other)
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	p := ParseQuery("orderId=1234&q=a+b%20c&flag&orderId=12&bad=%zz&=x")
+	checks := []struct {
+		name   string
+		values []string
+	}{
+		{"orderId", []string{"1234", "12"}},
+		{"q", []string{"a b c"}},
+		{"flag", []string{""}},
+		{"bad", []string{"%zz"}},
+		{"", []string{"x"}},
+	}
+	for _, c := range checks {
+		if strings.Join(p[c.name], ",") != strings.Join(c.values, ",") {
+			t.Errorf("Parameter %q: expecting %v, got %v", c.name, c.values, p[c.name])
+		}
+	}
+	if len(ParseQuery("-")) != 0 {
+		t.Errorf("Expecting no parameter for an empty query")
+	}
+}
+
+func TestASPError(t *testing.T) {
+	tests := []struct {
+		query   string
+		line    int
+		code    string
+		message string
+		request string
+	}{
+		{`|121|800a0046|File:___Permission_denied__Error_opening_log_file_C:\Windows\TEMP\API.Log`, 121, "800a0046", `File:   Permission denied  Error opening log file C:\Windows\TEMP\API.Log`, "-"},
+		{`id=3|45|80004005|Unspecified_error`, 45, "80004005", "Unspecified error", "id=3"},
+		{`id=3`, 0, "", "", "id=3"},
+		{`a|b`, 0, "", "", "a|b"},
+	}
+	for _, tc := range tests {
+		r := NewLogRecord("", nil)
+		r.Set("cs-uri-query", tc.query)
+		if r.Get("asp-line") != tc.line || r.Get("asp-error-code") != tc.code || r.Get("asp-error-message") != tc.message {
+			t.Errorf("Query %q: expecting %d, %q, %q, got %v, %q, %q", tc.query, tc.line, tc.code, tc.message, r.ASPLine, r.ASPErrorCode, r.ASPError)
+		}
+		if r.RequestQuery() != tc.request {
+			t.Errorf("Query %q: expecting request query %q, got %q", tc.query, tc.request, r.RequestQuery())
+		}
+	}
+}
+
+func TestParseContext(t *testing.T) {
+	log := strings.Repeat(extendedLog, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	records := NewLogParser(strings.NewReader(log)).ParseContext(ctx, nil)
+	<-records
+	cancel()
+	count := 0
+	for range records {
+		count++
+	}
+	if count > 1 {
+		t.Errorf("Expecting the parsing to stop when cancelled, got %d more records", count)
+	}
+}
+
+func TestRecords(t *testing.T) {
+	next, stop := iter.Pull(NewLogParser(strings.NewReader(extendedLog + extendedLog)).Records(nil))
+	defer stop()
+	for i := 0; i < 2; i++ {
+		if r, ok := next(); !ok || r.URI != "/myapp/default.asp" {
+			t.Fatalf("Expecting record %d, got %v", i, r)
+		}
+	}
+	if _, ok := next(); ok {
+		t.Errorf("Expecting the end of records")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	log := "#Date: 2017-01-31 09:00:00\n" +
+		"#Fields: date time cs-uri-stem sc-status time-taken\n" +
+		"2017-01-31 09:08:40 /a 200 10\n" +
+		"2017-01-31 09:08:41 /b abc 10\n" +
+		"2017-01-31 09:08:42 /c 200 10 extra\n" +
+		"2017-01-31 09:08:43 /d 200\n" +
+		"2017-01-31 09:08:43  200 10\n" +
+		"#Date: garbage\n" +
+		"#Date: 2017-01-31 09:00:00\n" +
+		"2017-01-31 09:08:44 /e 200 10\n"
+	p := NewLogParser(strings.NewReader(log))
+	errors := []*ParseError{}
+	p.SetErrorHandler(func(e *ParseError) bool {
+		errors = append(errors, e)
+		return true
+	})
+	uris := []string{}
+	for r := range p.Records(nil) {
+		uris = append(uris, r.URI)
+	}
+	if strings.Join(uris, ",") != "/a,/e" {
+		t.Errorf("Expecting /a and /e, got %v", uris)
+	}
+	lines := []int{4, 5, 6, 7, 8}
+	if len(errors) != len(lines) {
+		t.Fatalf("Expecting %d errors, got %v", len(lines), errors)
+	}
+	for i, e := range errors {
+		if e.Line != lines[i] {
+			t.Errorf("Expecting an error on line %d, got %v", lines[i], e)
+		}
+	}
+	if errors[0].Text != "2017-01-31 09:08:41 /b abc 10" {
+		t.Errorf("Expecting the line in the error, got %q", errors[0].Text)
+	}
+
+	// The handler stops the parsing
+	p = NewLogParser(strings.NewReader(log))
+	p.SetErrorHandler(func(e *ParseError) bool { return false })
+	count := 0
+	for range p.Records(nil) {
+		count++
+	}
+	if count != 1 {
+		t.Errorf("Expecting the parsing to stop at the first error, got %d records", count)
+	}
+}
+
+func TestProvenance(t *testing.T) {
+	p := NewLogParser(strings.NewReader(extendedLog + extendedLog))
+	p.SetSource("logs.zip", "W3SVC1/u_ex170131.log")
+	records := []*LogRecord{}
+	for r := range p.Records(nil) {
+		records = append(records, r)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Expecting 2 records, got %d", len(records))
+	}
+	offset := int64(strings.Index(extendedLog, "2017-01-31 09:08:40 W3SVC1"))
+	for i, r := range records {
+		if r.Get("source-file") != "logs.zip" || r.Get("source-member") != "W3SVC1/u_ex170131.log" {
+			t.Errorf("Record %d: expecting logs.zip[W3SVC1/u_ex170131.log], got %s[%s]", i, r.File, r.Member)
+		}
+		if r.Get("source-line") != 5+i*5 || r.Get("source-offset") != offset+int64(i*len(extendedLog)) {
+			t.Errorf("Record %d: unexpected line %d, offset %d", i, r.Line, r.Offset)
+		}
+		if r.Raw != strings.TrimRight(extendedLog[r.Offset-int64(i*len(extendedLog)):], "\n") {
+			t.Errorf("Record %d: offset %d doesn't give the line", i, r.Offset)
+		}
+	}
+}
@@ -0,0 +1,503 @@
+package iislog
+
+import (
+	"encoding/gob"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simulot/golib/pipeline"
+	"github.com/simulot/iislog/iis"
+)
+
+// An index is kept in a sidecar file, next to the log file or the archive it
+// describes. It gives for each log the time frame, servers, fields, and for each
+// block of lines, the time frame, status codes, users, and a bloom filter of
+// users, URI stems and client IPs. Searches read only the blocks that may match.
+// The index is ignored when the size or the modification time of the file change.
+
+// indexSuffix is appended to the name of the indexed file to get the index file
+const indexSuffix = ".iislog-index"
+
+// indexVersion changes when the index format changes
+const indexVersion = 1
+
+// blockLines is the number of records of an index block
+const blockLines = 4096
+
+// maxBlockUsers is the number of users listed in a block, above only the bloom filter is kept
+const maxBlockUsers = 256
+
+// logIndex is the content of an index file
+type logIndex struct {
+	Version int
+	Size    int64
+	ModTime time.Time
+	Files   map[string]*fileIndex // Log files, by archive member, "" for the file itself
+}
+
+// fileIndex describes a log file
+type fileIndex struct {
+	From, To time.Time // Time frame of records
+	Lines    int       // Count of records
+	Servers  []string
+	Fields   []string
+	Blocks   []*blockIndex
+}
+
+// blockIndex describes a block of lines of a log file
+type blockIndex struct {
+	Start    iis.Position // Where the parsing of the block starts
+	Size     int64        // Size of the block, -1 up to the end of the file
+	Lines    int          // Count of records
+	From, To time.Time    // Time frame of records
+	Statuses []int        // Status codes
+	Users    []string     // Users, nil when more than maxBlockUsers
+	Bloom    bloom        // Users, URI stems and client IPs
+}
+
+// ------------------------ bloom filter ---------------------------------
+
+// bloom is a bloom filter of strings. It tells when a string is surely absent.
+type bloom struct {
+	Bits []uint64
+	K    int
+}
+
+// newBloom makes a bloom filter for n strings, with about 1% of false positives
+func newBloom(n int) bloom {
+	return bloom{Bits: make([]uint64, (n*10)/64+1), K: 7}
+}
+
+// positions gives the bits of a string
+func (b bloom) positions(s string, f func(bit uint64)) {
+	h := fnv.New64a()
+	io.WriteString(h, s)
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32
+	m := uint64(len(b.Bits)) * 64
+	for i := uint64(0); i < uint64(b.K); i++ {
+		f((h1 + i*h2) % m)
+	}
+}
+
+func (b bloom) add(s string) {
+	b.positions(s, func(bit uint64) { b.Bits[bit/64] |= 1 << (bit % 64) })
+}
+
+// has returns false when s is surely not in the filter
+func (b bloom) has(s string) bool {
+	if len(b.Bits) == 0 {
+		return true
+	}
+	has := true
+	b.positions(s, func(bit uint64) {
+		if b.Bits[bit/64]&(1<<(bit%64)) == 0 {
+			has = false
+		}
+	})
+	return has
+}
+
+// bloomKey gives the key of a field value in bloom filters
+func bloomKey(field, value string) string {
+	return field + "=" + value
+}
+
+// ------------------------ index building ---------------------------------
+
+// blockBuilder collects values of a block
+type blockBuilder struct {
+	block    *blockIndex
+	statuses map[int]bool
+	users    map[string]bool
+	keys     map[string]bool
+}
+
+func newBlockBuilder(start iis.Position) *blockBuilder {
+	return &blockBuilder{
+		block:    &blockIndex{Start: start, Size: -1},
+		statuses: map[int]bool{},
+		users:    map[string]bool{},
+		keys:     map[string]bool{},
+	}
+}
+
+func (b *blockBuilder) add(r *iis.LogRecord) {
+	if b.block.Lines == 0 || r.DateTime.Before(b.block.From) {
+		b.block.From = r.DateTime
+	}
+	if r.DateTime.After(b.block.To) {
+		b.block.To = r.DateTime
+	}
+	b.block.Lines++
+	b.statuses[r.Status] = true
+	b.users[r.User] = true
+	b.keys[bloomKey("cs-username", r.User)] = true
+	b.keys[bloomKey("cs-uri-stem", r.URI)] = true
+	if r.Client != nil {
+		b.keys[bloomKey("c-ip", r.Client.String())] = true
+	}
+}
+
+// close ends the block before the line at position next
+func (b *blockBuilder) close(next *iis.Position) *blockIndex {
+	if next != nil {
+		b.block.Size = next.Offset - b.block.Start.Offset
+	}
+	for s := range b.statuses {
+		b.block.Statuses = append(b.block.Statuses, s)
+	}
+	sort.Ints(b.block.Statuses)
+	if len(b.users) <= maxBlockUsers {
+		b.block.Users = []string{}
+		for u := range b.users {
+			b.block.Users = append(b.block.Users, u)
+		}
+		sort.Strings(b.block.Users)
+	}
+	b.block.Bloom = newBloom(len(b.keys))
+	for k := range b.keys {
+		b.block.Bloom.add(k)
+	}
+	return b.block
+}
+
+// buildFileIndex reads a log file and makes its index
+func (a *Application) buildFileIndex(item logItem, r io.Reader) *fileIndex {
+	idx := &fileIndex{}
+	servers := map[string]bool{}
+	fields := map[string]bool{}
+	p := iis.NewLogParser(r)
+	p.SetSource(item.Source())
+	p.SetErrorHandler(a.errs.add)
+	var block *blockBuilder
+	for rec := range p.Records(nil) {
+		if a.context().Err() != nil {
+			return nil
+		}
+		if block == nil || block.block.Lines == blockLines {
+			pos := p.Position()
+			if block != nil {
+				idx.Blocks = append(idx.Blocks, block.close(&pos))
+			}
+			block = newBlockBuilder(pos)
+		}
+		block.add(rec)
+		if idx.Lines == 0 || rec.DateTime.Before(idx.From) {
+			idx.From = rec.DateTime
+		}
+		if rec.DateTime.After(idx.To) {
+			idx.To = rec.DateTime
+		}
+		idx.Lines++
+		if rec.ComputerName != "" {
+			servers[rec.ComputerName] = true
+		} else if rec.Server != nil {
+			servers[rec.Server.String()] = true
+		}
+		for _, f := range rec.Fields {
+			fields[f] = true
+		}
+	}
+	if block != nil {
+		idx.Blocks = append(idx.Blocks, block.close(nil))
+	}
+	if idx.Lines > 0 {
+		idx.To = idx.To.Add(time.Second)
+	}
+	for s := range servers {
+		idx.Servers = append(idx.Servers, s)
+	}
+	sort.Strings(idx.Servers)
+	for f := range fields {
+		idx.Fields = append(idx.Fields, f)
+	}
+	sort.Strings(idx.Fields)
+	return idx
+}
+
+// indexedFile is the index of a log file, with its source
+type indexedFile struct {
+	file, member string
+	info         os.FileInfo // Indexed file on disk
+	index        *fileIndex
+}
+
+// IndexOperator creates an operator that makes the index of log files.
+// Files already indexed are not read again.
+func (a *Application) IndexOperator() pipeline.Operator {
+	return func(in, out chan interface{}) {
+		for i := range in {
+			file, ok := i.(*logFile)
+			if !ok {
+				panic("Expecting *logFile in pipeline.Operator IndexOperator")
+			}
+			f := &indexedFile{}
+			f.file, f.member = file.item.Source()
+			info, err := os.Stat(f.file)
+			if err != nil || info.IsDir() {
+				// Not a file on disk, like the standard input
+				file.item.Close()
+				continue
+			}
+			f.info = info
+			if f.index = a.indexes.lookup(file.item); f.index == nil {
+				r, err := file.open()
+				if err != nil {
+					a.errs.report(file.item, err)
+					file.close()
+					continue
+				}
+				f.index = a.buildFileIndex(file.item, r)
+			}
+			file.close()
+			if f.index != nil {
+				out <- f
+			}
+		}
+	}
+}
+
+// IndexWriterOperator creates an operator that writes index files, and reports
+// indexed log files
+func (a *Application) IndexWriterOperator() pipeline.Operator {
+	return func(in, out chan interface{}) {
+		indexes := map[string]*logIndex{}
+		files := []*indexedFile{}
+		for i := range in {
+			f, ok := i.(*indexedFile)
+			if !ok {
+				panic("Expecting *indexedFile in pipeline.Operator IndexWriterOperator")
+			}
+			idx, ok := indexes[f.file]
+			if !ok {
+				idx = &logIndex{
+					Version: indexVersion,
+					Size:    f.info.Size(),
+					ModTime: f.info.ModTime(),
+					Files:   map[string]*fileIndex{},
+				}
+				indexes[f.file] = idx
+			}
+			idx.Files[f.member] = f.index
+			files = append(files, f)
+		}
+		if a.context().Err() != nil {
+			// Interrupted: indexes are incomplete
+			return
+		}
+		for file, idx := range indexes {
+			if err := writeIndex(file, idx); err != nil {
+				a.errs.add(&iis.ParseError{File: file, Err: err})
+			}
+		}
+
+		sort.Slice(files, func(i, j int) bool {
+			if files[i].file != files[j].file {
+				return files[i].file < files[j].file
+			}
+			return files[i].member < files[j].member
+		})
+		w := a.newRowWriter(a.out)
+		w.WriteHeader([]string{"file", "member", "from", "to", "lines", "blocks", "servers"})
+		for _, f := range files {
+			w.WriteRow([]interface{}{f.file, f.member, f.index.From, f.index.To, f.index.Lines, len(f.index.Blocks), strings.Join(f.index.Servers, " ")})
+		}
+		w.Flush()
+	}
+}
+
+// writeIndex writes the index file of file
+func writeIndex(file string, idx *logIndex) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(tmp).Encode(idx)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file+indexSuffix)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// readIndex reads the index of file, nil when there is no valid index
+func readIndex(file string) *logIndex {
+	info, err := os.Stat(file)
+	if err != nil || info.IsDir() {
+		return nil
+	}
+	f, err := os.Open(file + indexSuffix)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	idx := &logIndex{}
+	if err = gob.NewDecoder(f).Decode(idx); err != nil {
+		return nil
+	}
+	if idx.Version != indexVersion || idx.Size != info.Size() || !idx.ModTime.Equal(info.ModTime()) {
+		// The file has changed since it was indexed
+		return nil
+	}
+	return idx
+}
+
+// ------------------------ index usage ---------------------------------
+
+// indexCache keeps index files read during a search. A nil cache gives no index.
+type indexCache struct {
+	sync.Mutex
+	indexes map[string]*logIndex
+}
+
+func newIndexCache() *indexCache {
+	return &indexCache{indexes: map[string]*logIndex{}}
+}
+
+// lookup gives the index of a log file, nil if none
+func (c *indexCache) lookup(item logItem) *fileIndex {
+	if c == nil {
+		return nil
+	}
+	file, member := item.Source()
+	c.Lock()
+	idx, ok := c.indexes[file]
+	if !ok {
+		idx = readIndex(file)
+		c.indexes[file] = idx
+	}
+	c.Unlock()
+	if idx == nil {
+		return nil
+	}
+	return idx.Files[member]
+}
+
+// mayMatch returns false when no record of the block can match the query
+func (a *Application) mayMatch(b *blockIndex) bool {
+	if b.Lines == 0 || !b.To.After(a.dateFrom) || !b.From.Before(a.dateTo) {
+		return false
+	}
+	statuses := []interface{}{}
+	hasError := false
+	for _, s := range b.Statuses {
+		statuses = append(statuses, s)
+		hasError = hasError || (s >= 400 && s < 600)
+	}
+	if a.protocolError && !hasError {
+		return false
+	}
+	if b.Users != nil && len(a.users) > 0 {
+		found := false
+		for _, u := range b.Users {
+			for _, want := range a.users {
+				found = found || strings.Contains(u, want)
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if a.where == nil {
+		return true
+	}
+	if !a.where.MayMatch("sc-status", statuses) {
+		return false
+	}
+	if b.Users != nil {
+		users := []interface{}{}
+		for _, u := range b.Users {
+			users = append(users, u)
+		}
+		if !a.where.MayMatch("cs-username", users) {
+			return false
+		}
+	}
+	for _, field := range []string{"cs-username", "cs-uri-stem", "c-ip"} {
+		if values, ok := a.where.Values(field); ok {
+			found := false
+			for _, v := range values {
+				found = found || b.Bloom.has(bloomKey(field, v))
+			}
+			if !found {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// indexedBlocks gives the blocks of a log file that may match the query, nil when
+// all blocks may match, and the time frame of the file. It returns ok false when
+// the file has no index.
+func (a *Application) indexedBlocks(item logItem) (blocks []*blockIndex, from, to time.Time, ok bool) {
+	idx := a.indexes.lookup(item)
+	if idx == nil {
+		return nil, time.Time{}, time.Time{}, false
+	}
+	blocks = []*blockIndex{}
+	for _, b := range idx.Blocks {
+		if a.mayMatch(b) {
+			blocks = append(blocks, b)
+		}
+	}
+	if len(blocks) == len(idx.Blocks) && len(blocks) > 0 {
+		// The whole file is read
+		blocks = nil
+	}
+	return blocks, idx.From, idx.To, true
+}
+
+// blockRecords parses the blocks of a log file, and emits their records
+func (s *recordStream) blockRecords(r io.Reader, blocks []*blockIndex) chan *iis.LogRecord {
+	out := make(chan *iis.LogRecord)
+	go func() {
+		defer close(out)
+		pos := int64(0)
+		for _, b := range blocks {
+			// Skips to the block
+			if seeker, ok := r.(io.Seeker); ok {
+				if _, err := seeker.Seek(b.Start.Offset, io.SeekStart); err != nil {
+					s.errs.report(s.file.item, err)
+					return
+				}
+			} else if _, err := io.CopyN(io.Discard, r, b.Start.Offset-pos); err != nil {
+				s.errs.report(s.file.item, fmt.Errorf("index doesn't match the file: %w", err))
+				return
+			}
+			pos = b.Start.Offset
+			br := r
+			if b.Size >= 0 {
+				br = io.LimitReader(r, b.Size)
+				pos += b.Size
+			}
+			p := iis.NewLogParser(br)
+			p.Resume(b.Start)
+			p.SetSource(s.file.item.Source())
+			p.SetErrorHandler(s.errs.add)
+			for rec := range p.ParseContext(s.ctx, s.filter) {
+				select {
+				case out <- rec:
+				case <-s.ctx.Done():
+				}
+			}
+			if s.ctx.Err() != nil {
+				return
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,90 @@
+package iislog
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/simulot/iislog/expr"
+)
+
+func TestBloom(t *testing.T) {
+	b := newBloom(1000)
+	for i := 0; i < 1000; i++ {
+		b.add(fmt.Sprint("user", i))
+	}
+	falsePositives := 0
+	for i := 0; i < 1000; i++ {
+		if !b.has(fmt.Sprint("user", i)) {
+			t.Fatalf("user%d not found", i)
+		}
+		if b.has(fmt.Sprint("other", i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 30 {
+		t.Errorf("Expecting about 1%% of false positives, got %d in 1000", falsePositives)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	// A log of 3 blocks, alice is in the second one
+	dir := t.TempDir()
+	log := &strings.Builder{}
+	log.WriteString("#Date: 2017-02-01 00:00:00\r\n#Fields: date time cs-username cs-uri-stem sc-status\r\n")
+	lines := []string{}
+	for i := 0; i < 2*blockLines+100; i++ {
+		user := fmt.Sprint("user", i%50)
+		if i == blockLines+10 {
+			user = "alice"
+		}
+		line := fmt.Sprintf("2017-02-01 %02d:%02d:%02d %s /page%d 200", i/3600, (i/60)%60, i%60, user, i%10)
+		lines = append(lines, line)
+		log.WriteString(line + "\r\n")
+	}
+	file := filepath.Join(dir, "u_ex170201.log")
+	if err := os.WriteFile(file, []byte(log.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewApplication()
+	a.command = indexCommand
+	a.files = []string{dir}
+	a.SetOutput(io.Discard)
+	if err := a.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Breaks the first and the last blocks, without changing size and time of the file
+	info, _ := os.Stat(file)
+	data := log.String()
+	for _, line := range []string{lines[0], lines[2*blockLines]} {
+		data = strings.Replace(data, line, strings.Repeat("x", len(line)), 1)
+	}
+	os.WriteFile(file, []byte(data), 0644)
+	os.Chtimes(file, info.ModTime(), info.ModTime())
+
+	search := func(noIndex bool) (string, int) {
+		a := NewApplication()
+		a.where, _ = expr.Compile(`user == "alice"`)
+		a.noIndex = noIndex
+		a.files = []string{dir}
+		a.columns = []string{"cs-username", "cs-uri-stem"}
+		b := bytes.NewBuffer(nil)
+		a.SetOutput(b)
+		a.Run()
+		return b.String(), a.errs.count
+	}
+
+	expected := "cs-username;cs-uri-stem\r\nalice;/page6\r\n"
+	if got, errors := search(false); got != expected || errors != 0 {
+		t.Errorf("With index, expecting %q and no error, got %q and %d errors", expected, got, errors)
+	}
+	if got, errors := search(true); got != expected || errors != 2 {
+		t.Errorf("Without index, expecting %q and 2 errors, got %q and %d errors", expected, got, errors)
+	}
+}
@@ -0,0 +1,119 @@
+package iislog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"time"
+
+	"github.com/simulot/golib/pipeline"
+	"github.com/simulot/iislog/iis"
+)
+
+// jsonlWriter writes JSON objects, one per line
+type jsonlWriter struct {
+	w       *bufio.Writer
+	buf     bytes.Buffer
+	enc     *json.Encoder
+	columns []string
+}
+
+func newJSONLWriter(w io.Writer) *jsonlWriter {
+	j := &jsonlWriter{w: bufio.NewWriter(w)}
+	j.enc = json.NewEncoder(&j.buf)
+	j.enc.SetEscapeHTML(false)
+	return j
+}
+
+// WriteHeader gives keys of objects written by WriteRow
+func (j *jsonlWriter) WriteHeader(columns []string) error {
+	j.columns = columns
+	return nil
+}
+
+// WriteRow writes an object made of header keys and given values
+func (j *jsonlWriter) WriteRow(values []interface{}) error {
+	return j.writeObject(j.columns, values)
+}
+
+func (j *jsonlWriter) Flush() error {
+	return j.w.Flush()
+}
+
+// writeObject writes an object keeping keys in the given order
+func (j *jsonlWriter) writeObject(keys []string, values []interface{}) error {
+	j.buf.Reset()
+	j.buf.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			j.buf.WriteByte(',')
+		}
+		if err := j.enc.Encode(k); err != nil {
+			return err
+		}
+		j.buf.Truncate(j.buf.Len() - 1) // Encode adds a new line
+		j.buf.WriteByte(':')
+		if err := j.enc.Encode(jsonValue(values[i])); err != nil {
+			return err
+		}
+		j.buf.Truncate(j.buf.Len() - 1)
+	}
+	j.buf.WriteString("}\n")
+	_, err := j.w.Write(j.buf.Bytes())
+	return err
+}
+
+// jsonValue converts record values into their JSON representation:
+// durations in milliseconds, timestamps in RFC 3339
+func jsonValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case time.Duration:
+		return int64(t / time.Millisecond)
+	case time.Time:
+		return t.Format(time.RFC3339)
+	case net.IP:
+		if t == nil {
+			return nil
+		}
+		return t.String()
+	}
+	return v
+}
+
+// recordObject gives keys and values of all fields read from the log
+func (a *Application) recordObject(r *iis.LogRecord) ([]string, []interface{}) {
+	keys := logColumns(r)
+	values := make([]interface{}, len(keys))
+	for i, k := range keys {
+		values[i] = a.makeColumn(k).value(r)
+	}
+	if r.ASPErrorCode != "" {
+		keys = append(keys, "asp-line", "asp-error-code", "asp-error-message")
+		values = append(values, r.ASPLine, r.ASPErrorCode, r.ASPError)
+	}
+	if a.decode {
+		keys = append(keys, "params")
+		values = append(values, r.Params())
+	}
+	return keys, values
+}
+
+// jsonlOutputOperator creates an output writing a JSON object per record
+func (a *Application) jsonlOutputOperator() pipeline.Operator {
+	return func(in, out chan interface{}) {
+		w := newJSONLWriter(a.out)
+		for i := range in {
+			if item, ok := i.(*iis.LogRecord); ok {
+				w.writeObject(a.recordObject(item))
+				if a.command == tailCommand {
+					w.Flush()
+				}
+			} else {
+				panic("Expecting *iis.LogRecord in pipeline.Operator OutputOperator")
+			}
+		}
+		w.Flush()
+	}
+}
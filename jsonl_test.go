@@ -0,0 +1,38 @@
+package iislog
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestJSONL(t *testing.T) {
+	log := "#Date: 2017-01-31 09:00:00\r\n" +
+		"#Fields: date time c-ip cs-uri-stem cs-uri-query s-port sc-status sc-bytes time-taken\r\n" +
+		"2017-01-31 09:08:40 10.0.0.1 /a q=<b>&x=1 443 200 1024 2246\r\n" +
+		"2017-01-31 09:08:41 - /b - 443 404 0 15\r\n"
+
+	tests := []struct {
+		columns  []string
+		expected string
+	}{
+		{nil, `{"datetime":"2017-01-31T09:08:40Z","c-ip":"10.0.0.1","cs-uri-stem":"/a","cs-uri-query":"q=<b>&x=1","s-port":443,"sc-status":200,"sc-bytes":1024,"time-taken":2246,"status-label":"OK. The client request has succeeded"}` + "\n" +
+			`{"datetime":"2017-01-31T09:08:41Z","c-ip":null,"cs-uri-stem":"/b","cs-uri-query":"-","s-port":443,"sc-status":404,"sc-bytes":0,"time-taken":15,"status-label":"Not found"}` + "\n"},
+		{[]string{"datetime", "uri", "time-taken(ms)", "time-taken"}, `{"datetime":"2017-01-31T09:08:40Z","uri":"/a","time-taken(ms)":2246,"time-taken":2246}` + "\n" +
+			`{"datetime":"2017-01-31T09:08:41Z","uri":"/b","time-taken(ms)":15,"time-taken":15}` + "\n"},
+	}
+	for _, tt := range tests {
+		a := NewApplication()
+		a.command = convertCommand
+		a.format = "jsonl"
+		a.columns = tt.columns
+		b := bytes.NewBuffer(nil)
+		a.SetOutput(b)
+		if err := a.RunReaders(NamedReader{Name: "u_ex170131.log", Reader: strings.NewReader(log)}); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != tt.expected {
+			t.Errorf("%v: expecting\n%s\ngot\n%s", tt.columns, tt.expected, b.String())
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package iislog
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/simulot/iislog/iis"
+)
+
+// lokiClient sends records to the push API of Loki, as JSON lines in streams
+// labelled by site, server and status class
+type lokiClient struct {
+	url  string // Push endpoint
+	line *recordLine
+}
+
+func newLokiClient(server string, object func(*iis.LogRecord) ([]string, []interface{})) *lokiClient {
+	return &lokiClient{url: sinkEndpoint(server, "/loki/api/v1/push"), line: newRecordLine(object)}
+}
+
+// lokiStream is a stream of the push API, with its entries: time in nanoseconds, and line
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+// lokiLabels gives the labels of the stream of a record
+func lokiLabels(r *iis.LogRecord) map[string]string {
+	labels := map[string]string{"status_class": statusClass(r.Status)}
+	if r.SiteName != "" {
+		labels["site"] = r.SiteName
+	}
+	switch {
+	case r.ComputerName != "":
+		labels["server"] = r.ComputerName
+	case r.Server != nil:
+		labels["server"] = r.Server.String()
+	}
+	return labels
+}
+
+func (c *lokiClient) request(records []*iis.LogRecord) (*http.Request, error) {
+	streams := []*lokiStream{}
+	byLabels := map[[3]string]*lokiStream{}
+	for _, r := range records {
+		labels := lokiLabels(r)
+		key := [3]string{labels["site"], labels["server"], labels["status_class"]}
+		s, ok := byLabels[key]
+		if !ok {
+			s = &lokiStream{Stream: labels}
+			byLabels[key] = s
+			streams = append(streams, s)
+		}
+		line, err := c.line.format(r)
+		if err != nil {
+			return nil, err
+		}
+		s.Values = append(s.Values, [2]string{strconv.FormatInt(r.DateTime.UnixNano(), 10), string(line)})
+	}
+	body, err := json.Marshal(struct {
+		Streams []*lokiStream `json:"streams"`
+	}{streams})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// check has nothing to check: Loki accepts or refuses the whole batch
+func (c *lokiClient) check(resp *http.Response, records []*iis.LogRecord) ([]*iis.LogRecord, []*iis.ParseError) {
+	return nil, nil
+}
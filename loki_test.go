@@ -0,0 +1,92 @@
+package iislog
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoki(t *testing.T) {
+	var pushed []lokiStream
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/loki/api/v1/push" {
+			http.NotFound(w, r)
+			return
+		}
+		body := struct{ Streams []lokiStream }{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pushed = append(pushed, body.Streams...)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	log := "#Date: 2017-01-31 09:00:00\r\n" +
+		"#Fields: date time s-sitename s-computername cs-uri-stem sc-status\r\n" +
+		"2017-01-31 09:08:40 W3SVC1 IIS-1 /a 200\r\n" +
+		"2017-01-31 09:08:41 W3SVC1 IIS-1 /b 503\r\n" +
+		"2017-01-31 09:08:42 W3SVC1 IIS-1 /c 204\r\n"
+	a := NewApplication()
+	a.command = convertCommand
+	a.format = "loki"
+	a.output = srv.URL
+	a.strict = true
+	if err := a.RunReaders(NamedReader{Name: "u_ex170131.log", Reader: strings.NewReader(log)}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := []string{}
+	for _, s := range pushed {
+		b, _ := json.Marshal(s)
+		got = append(got, string(b))
+	}
+	expected := []string{
+		`{"stream":{"server":"IIS-1","site":"W3SVC1","status_class":"2xx"},"values":[` +
+			`["1485853720000000000","{\"datetime\":\"2017-01-31T09:08:40Z\",\"s-sitename\":\"W3SVC1\",\"s-computername\":\"IIS-1\",\"cs-uri-stem\":\"/a\",\"sc-status\":200,\"status-label\":\"OK. The client request has succeeded\"}"],` +
+			`["1485853722000000000","{\"datetime\":\"2017-01-31T09:08:42Z\",\"s-sitename\":\"W3SVC1\",\"s-computername\":\"IIS-1\",\"cs-uri-stem\":\"/c\",\"sc-status\":204,\"status-label\":\"No content\"}"]]}`,
+		`{"stream":{"server":"IIS-1","site":"W3SVC1","status_class":"5xx"},"values":[` +
+			`["1485853721000000000","{\"datetime\":\"2017-01-31T09:08:41Z\",\"s-sitename\":\"W3SVC1\",\"s-computername\":\"IIS-1\",\"cs-uri-stem\":\"/b\",\"sc-status\":503,\"status-label\":\"Application pool unavailable\"}"]]}`,
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expecting streams:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestLokiFailure(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, "entry too far behind", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	log := strings.Builder{}
+	log.WriteString("#Date: 2017-01-31 09:00:00\r\n#Fields: date time cs-uri-stem sc-status\r\n")
+	for i := 0; i < 3*sinkBatchSize; i++ {
+		fmt.Fprintf(&log, "2017-01-31 09:%02d:%02d /a 200\r\n", i/60%60, i%60)
+	}
+	a := NewApplication()
+	a.command = convertCommand
+	a.format = "loki"
+	a.output = srv.URL
+	a.checkpoint = filepath.Join(t.TempDir(), "checkpoint.json")
+	err := a.RunReaders(NamedReader{Name: "u_ex170131.log", Reader: strings.NewReader(log.String())})
+
+	// The first batch refused stops the run
+	if err == nil || !strings.Contains(err.Error(), "entry too far behind") {
+		t.Errorf("Expecting the error of the server, got %v", err)
+	}
+	if requests != 1 {
+		t.Errorf("Expecting no more batches after the failure, got %d requests", requests)
+	}
+	if _, err = os.Stat(a.checkpoint); !os.IsNotExist(err) {
+		t.Errorf("Expecting no checkpoint, got %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+package iislog
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"time"
+
+	"github.com/simulot/golib/pipeline"
+	"github.com/simulot/iislog/iis"
+)
+
+// dedupeWindow is the time during which a line is remembered to detect duplicates
+const dedupeWindow = time.Minute
+
+// MergeOperator creates an operator that merges record streams of all log files
+// into a single flow sorted by date, and removes duplicated lines.
+//
+// Each log file is already sorted by time. Files are opened only when the
+// merge reaches their starting date, so only overlapping files are parsed
+// simultaneously, and records are emitted as soon as no other file can have an
+// older one.
+func (a *Application) MergeOperator() pipeline.Operator {
+	return func(in, out chan interface{}) {
+		pending := streamsByStart{}
+		for i := range in {
+			if s, ok := i.(*recordStream); ok {
+				pending = append(pending, s)
+			} else {
+				panic("Expecting *recordStream in pipeline.Operator MergeOperator")
+			}
+		}
+		heap.Init(&pending)
+
+		active := streamsByHead{}
+		seen := newDeduplicator(dedupeWindow)
+		ctx := a.context()
+		for pending.Len() > 0 || active.Len() > 0 {
+			if ctx.Err() != nil {
+				// Interrupted: records already emitted are kept, other files are closed
+				for _, s := range append(pending, active...) {
+					s.close()
+				}
+				return
+			}
+
+			// Opens the next file when it may have records older than the next one to be emitted
+			if pending.Len() > 0 && (active.Len() == 0 || !pending[0].file.from.After(active[0].head.DateTime)) {
+				s := heap.Pop(&pending).(*recordStream)
+				s.open()
+				if s.next() {
+					heap.Push(&active, s)
+				}
+				continue
+			}
+
+			s := active[0]
+			if !seen.check(s.head) {
+				select {
+				case out <- s.head:
+				case <-ctx.Done():
+					continue
+				}
+			}
+			if s.next() {
+				heap.Fix(&active, 0)
+			} else {
+				heap.Pop(&active)
+			}
+		}
+	}
+}
+
+// streamsByStart is a heap of streams not yet opened, ordered by file date
+type streamsByStart []*recordStream
+
+func (h streamsByStart) Len() int            { return len(h) }
+func (h streamsByStart) Less(i, j int) bool  { return h[i].file.from.Before(h[j].file.from) }
+func (h streamsByStart) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *streamsByStart) Push(x interface{}) { *h = append(*h, x.(*recordStream)) }
+func (h *streamsByStart) Pop() interface{} {
+	old := *h
+	s := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return s
+}
+
+// streamsByHead is a heap of opened streams, ordered by their next record date
+type streamsByHead []*recordStream
+
+func (h streamsByHead) Len() int            { return len(h) }
+func (h streamsByHead) Less(i, j int) bool  { return h[i].head.DateTime.Before(h[j].head.DateTime) }
+func (h streamsByHead) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *streamsByHead) Push(x interface{}) { *h = append(*h, x.(*recordStream)) }
+func (h *streamsByHead) Pop() interface{} {
+	old := *h
+	s := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return s
+}
+
+// deduplicator remembers hashes of lines emitted during the last window.
+// Duplicated lines have the same date, so older lines can be forgotten.
+type deduplicator struct {
+	window            time.Duration
+	start             time.Time // Start of the current generation
+	current, previous map[uint64]bool
+}
+
+func newDeduplicator(window time.Duration) *deduplicator {
+	return &deduplicator{
+		window:   window,
+		current:  map[uint64]bool{},
+		previous: map[uint64]bool{},
+	}
+}
+
+// check returns true when the record has already been seen
+func (d *deduplicator) check(r *iis.LogRecord) bool {
+	if r.DateTime.Sub(d.start) > d.window {
+		d.previous, d.current = d.current, map[uint64]bool{}
+		d.start = r.DateTime
+	}
+	h := fnv.New64a()
+	h.Write([]byte(r.Raw))
+	k := h.Sum64()
+	if d.current[k] || d.previous[k] {
+		return true
+	}
+	d.current[k] = true
+	return false
+}
@@ -0,0 +1,35 @@
+package iislog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/simulot/iislog/iis"
+)
+
+func TestDeduplicator(t *testing.T) {
+	t0 := time.Date(2017, 1, 31, 9, 8, 40, 0, time.UTC)
+	rec := func(d time.Duration, raw string) *iis.LogRecord {
+		return &iis.LogRecord{DateTime: t0.Add(d), Raw: raw}
+	}
+
+	d := newDeduplicator(time.Minute)
+	tests := []struct {
+		r    *iis.LogRecord
+		seen bool
+	}{
+		{rec(0, "a"), false},
+		{rec(0, "b"), false},
+		{rec(0, "a"), true},
+		{rec(30*time.Second, "c"), false},
+		{rec(90*time.Second, "a"), true}, // still in the previous generation
+		{rec(90*time.Second, "d"), false},
+		{rec(5*time.Minute, "a"), false}, // forgotten
+		{rec(5*time.Minute, "a"), true},
+	}
+	for i, tc := range tests {
+		if got := d.check(tc.r); got != tc.seen {
+			t.Errorf("Record #%d %q: expecting seen %v, got %v", i, tc.r.Raw, tc.seen, got)
+		}
+	}
+}
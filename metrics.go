@@ -0,0 +1,287 @@
+package iislog
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simulot/golib/pipeline"
+	"github.com/simulot/iislog/iis"
+)
+
+// Metrics are written in the Prometheus text format:
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+
+// maxMetricURIs is the number of distinct URIs in metrics, other ones are counted as "other"
+const maxMetricURIs = 1000
+
+// durationBuckets are the upper bounds of time-taken histograms, in seconds
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// requestLabels are labels of request counters
+type requestLabels struct {
+	site, statusClass, method, uri string
+}
+
+// durationLabels are labels of time-taken histograms
+type durationLabels struct {
+	site, uri string
+}
+
+// histogram counts observations by bucket
+type histogram struct {
+	buckets []uint64 // Count of observations lower or equal to each of durationBuckets
+	count   uint64
+	sum     float64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.buckets == nil {
+		h.buckets = make([]uint64, len(durationBuckets))
+	}
+	for i, b := range durationBuckets {
+		if v <= b {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// metrics are counters and histograms derived from log records
+type metrics struct {
+	sync.Mutex
+	requests  map[requestLabels]uint64
+	durations map[durationLabels]*histogram
+	sent      map[string]int64     // sc-bytes by site
+	received  map[string]int64     // cs-bytes by site
+	last      map[string]time.Time // Last record by site
+	uris      map[string]bool      // URIs having metrics
+	errs      *parseErrors         // Lines that can't be parsed
+}
+
+func newMetrics(errs *parseErrors) *metrics {
+	return &metrics{
+		requests:  map[requestLabels]uint64{},
+		durations: map[durationLabels]*histogram{},
+		sent:      map[string]int64{},
+		received:  map[string]int64{},
+		last:      map[string]time.Time{},
+		uris:      map[string]bool{},
+		errs:      errs,
+	}
+}
+
+// idSegment matches URI segments that are identifiers: numbers, GUIDs, long hexadecimal strings
+var idSegment = regexp.MustCompile(`^(?:\d+|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}|[0-9a-fA-F]{16,})$`)
+
+// normalizeURI gives the URI in metrics labels: lower case, as IIS URIs are case
+// insensitive, with identifiers replaced by :id
+func normalizeURI(uri string) string {
+	segments := strings.Split(strings.ToLower(uri), "/")
+	for i, s := range segments {
+		if idSegment.MatchString(s) {
+			segments[i] = ":id"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// statusClass gives the class of a status code, like 2xx or 5xx
+func statusClass(status int) string {
+	if status >= 100 && status < 600 {
+		return strconv.Itoa(status/100) + "xx"
+	}
+	return "unknown"
+}
+
+// httpMethods are the methods kept in metrics labels, other ones being counted as other
+var httpMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodConnect: true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+// metricMethod gives the method in metrics labels: a standard HTTP method, or other
+func metricMethod(method string) string {
+	if httpMethods[method] {
+		return method
+	}
+	return "other"
+}
+
+// add counts a record
+func (m *metrics) add(r *iis.LogRecord) {
+	site := r.SiteName
+	uri := normalizeURI(r.URI)
+	class := statusClass(r.Status)
+
+	m.Lock()
+	defer m.Unlock()
+	if !m.uris[uri] {
+		if len(m.uris) < maxMetricURIs {
+			m.uris[uri] = true
+		} else {
+			uri = "other"
+		}
+	}
+	m.requests[requestLabels{site, class, metricMethod(r.Method), uri}]++
+	h, ok := m.durations[durationLabels{site, uri}]
+	if !ok {
+		h = &histogram{}
+		m.durations[durationLabels{site, uri}] = h
+	}
+	h.observe(r.TimeTaken.Seconds())
+	m.sent[site] += r.BytesSent
+	m.received[site] += r.BytesReceived
+	if r.DateTime.After(m.last[site]) {
+		m.last[site] = r.DateTime
+	}
+}
+
+// labelEscaper escapes label values
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats label pairs
+func labels(pairs ...string) string {
+	b := strings.Builder{}
+	b.WriteByte('{')
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(pairs[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// formatFloat formats sample values
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sortedLines writes lines sorted, for stable scrapes
+func sortedLines(w io.Writer, lines []string) {
+	sort.Strings(lines)
+	for _, l := range lines {
+		io.WriteString(w, l)
+	}
+}
+
+// write writes metrics in the Prometheus text format
+func (m *metrics) write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	m.Lock()
+
+	fmt.Fprintln(bw, "# HELP iislog_requests_total Requests logged by IIS.")
+	fmt.Fprintln(bw, "# TYPE iislog_requests_total counter")
+	lines := []string{}
+	for l, v := range m.requests {
+		lines = append(lines, fmt.Sprintf("iislog_requests_total%s %d\n", labels("site", l.site, "status_class", l.statusClass, "method", l.method, "uri", l.uri), v))
+	}
+	sortedLines(bw, lines)
+
+	fmt.Fprintln(bw, "# HELP iislog_request_duration_seconds Time taken by requests.")
+	fmt.Fprintln(bw, "# TYPE iislog_request_duration_seconds histogram")
+	lines = lines[:0]
+	for l, h := range m.durations {
+		s := strings.Builder{}
+		for i, b := range durationBuckets {
+			fmt.Fprintf(&s, "iislog_request_duration_seconds_bucket%s %d\n", labels("site", l.site, "uri", l.uri, "le", formatFloat(b)), h.buckets[i])
+		}
+		fmt.Fprintf(&s, "iislog_request_duration_seconds_bucket%s %d\n", labels("site", l.site, "uri", l.uri, "le", "+Inf"), h.count)
+		fmt.Fprintf(&s, "iislog_request_duration_seconds_sum%s %s\n", labels("site", l.site, "uri", l.uri), formatFloat(h.sum))
+		fmt.Fprintf(&s, "iislog_request_duration_seconds_count%s %d\n", labels("site", l.site, "uri", l.uri), h.count)
+		lines = append(lines, s.String())
+	}
+	sortedLines(bw, lines)
+
+	for _, c := range []struct {
+		name, help string
+		values     map[string]int64
+	}{
+		{"iislog_response_bytes_total", "Bytes sent by the server (sc-bytes).", m.sent},
+		{"iislog_request_bytes_total", "Bytes received by the server (cs-bytes).", m.received},
+	} {
+		fmt.Fprintf(bw, "# HELP %s %s\n", c.name, c.help)
+		fmt.Fprintf(bw, "# TYPE %s counter\n", c.name)
+		lines = lines[:0]
+		for site, v := range c.values {
+			lines = append(lines, fmt.Sprintf("%s%s %d\n", c.name, labels("site", site), v))
+		}
+		sortedLines(bw, lines)
+	}
+
+	fmt.Fprintln(bw, "# HELP iislog_last_request_timestamp_seconds Time of the last request logged.")
+	fmt.Fprintln(bw, "# TYPE iislog_last_request_timestamp_seconds gauge")
+	lines = lines[:0]
+	for site, t := range m.last {
+		lines = append(lines, fmt.Sprintf("iislog_last_request_timestamp_seconds%s %d\n", labels("site", site), t.Unix()))
+	}
+	sortedLines(bw, lines)
+	m.Unlock()
+
+	if m.errs != nil {
+		m.errs.Lock()
+		count := m.errs.count
+		m.errs.Unlock()
+		fmt.Fprintln(bw, "# HELP iislog_parse_errors_total Log lines that can't be parsed.")
+		fmt.Fprintln(bw, "# TYPE iislog_parse_errors_total counter")
+		fmt.Fprintf(bw, "iislog_parse_errors_total %d\n", count)
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP serves metrics
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.write(w)
+}
+
+// MetricsOperator creates an operator that counts records into metrics
+func (a *Application) MetricsOperator(m *metrics) pipeline.Operator {
+	return func(in, out chan interface{}) {
+		for i := range in {
+			item, ok := i.(*iis.LogRecord)
+			if !ok {
+				panic("Expecting *iis.LogRecord in pipeline.Operator MetricsOperator")
+			}
+			m.add(item)
+		}
+	}
+}
+
+// serveMetrics serves metrics on /metrics at the listen address, until the context is done
+func (a *Application) serveMetrics(m *metrics) error {
+	l, err := net.Listen("tcp", a.listen)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(l)
+	go func() {
+		<-a.context().Done()
+		srv.Close()
+	}()
+	return nil
+}
@@ -0,0 +1,65 @@
+package iislog
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/simulot/iislog/iis"
+)
+
+func TestNormalizeURI(t *testing.T) {
+	tests := map[string]string{
+		"/":                   "/",
+		"/MyApp/Default.aspx": "/myapp/default.aspx",
+		"/api/orders/12345":   "/api/orders/:id",
+		"/api/users/0f8fad5b-d9cb-469f-a165-70867728950e/roles": "/api/users/:id/roles",
+		"/files/9f86d081884c7d659a2feaa0c55ad015":               "/files/:id",
+		"/v2/items": "/v2/items",
+	}
+	for uri, expected := range tests {
+		if got := normalizeURI(uri); got != expected {
+			t.Errorf("%s: expecting %s, got %s", uri, expected, got)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	log := "#Date: 2017-01-31 09:00:00\r\n" +
+		"#Fields: date time s-sitename cs-method cs-uri-stem sc-status sc-bytes time-taken\r\n" +
+		"2017-01-31 09:08:40 W3SVC1 GET /api/orders/1 200 1000 20\r\n" +
+		"2017-01-31 09:08:41 W3SVC1 GET /api/orders/2 200 500 300\r\n" +
+		"2017-01-31 09:08:42 W3SVC1 POST /api/orders 503 100 6000\r\n" +
+		"2017-01-31 09:08:43 W3SVC1 GET /bad x 0 0\r\n" +
+		"2017-01-31 09:08:44 W3SVC1 PROPFIND /dav 207 100 10\r\n"
+	errs := newParseErrors(false, nil, nil)
+	m := newMetrics(errs)
+	p := iis.NewLogParser(strings.NewReader(log))
+	p.SetErrorHandler(errs.add)
+	for r := range p.Records(nil) {
+		m.add(r)
+	}
+	b := bytes.NewBuffer(nil)
+	if err := m.write(b); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		`iislog_requests_total{site="W3SVC1",status_class="2xx",method="GET",uri="/api/orders/:id"} 2`,
+		`iislog_requests_total{site="W3SVC1",status_class="5xx",method="POST",uri="/api/orders"} 1`,
+		`iislog_requests_total{site="W3SVC1",status_class="2xx",method="other",uri="/dav"} 1`,
+		`iislog_request_duration_seconds_bucket{site="W3SVC1",uri="/api/orders/:id",le="0.025"} 1`,
+		`iislog_request_duration_seconds_bucket{site="W3SVC1",uri="/api/orders/:id",le="0.5"} 2`,
+		`iislog_request_duration_seconds_bucket{site="W3SVC1",uri="/api/orders",le="5"} 0`,
+		`iislog_request_duration_seconds_bucket{site="W3SVC1",uri="/api/orders",le="+Inf"} 1`,
+		`iislog_request_duration_seconds_sum{site="W3SVC1",uri="/api/orders/:id"} 0.32`,
+		`iislog_request_duration_seconds_count{site="W3SVC1",uri="/api/orders/:id"} 2`,
+		`iislog_response_bytes_total{site="W3SVC1"} 1700`,
+		`iislog_last_request_timestamp_seconds{site="W3SVC1"} 1485853724`,
+		`iislog_parse_errors_total 1`,
+	} {
+		if !strings.Contains(b.String(), expected+"\n") {
+			t.Errorf("Expecting %s in:\n%s", expected, b.String())
+		}
+	}
+}
@@ -1,10 +1,14 @@
 package iislog
 
 import (
+	"fmt"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"os"
 
+	"github.com/simulot/iislog/expr"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
@@ -50,9 +54,134 @@ func (a *Application) ParseCommandLine() (string, error) {
 	app.Flag("long-queries", "show queries longer than 'DURATION'. Accepted values like 200ms, 3s, 1m...").PlaceHolder("DURATION").
 		DurationVar(&a.longQueries)
 
-	app.Arg("file", "file, path, zip archive").Required().StringsVar(&a.files)
+	where := ""
+	app.Flag("where", "Reports lines matching the EXPRESSION, like: status >= 500 && uri ~ \"^/api/\" && time-taken > 2s").PlaceHolder("EXPRESSION").Action(func(c *kingpin.ParseContext) (err error) {
+		a.where, err = expr.Compile(where)
+		return err
+	}).StringVar(&where)
+
+	app.Flag("param", "Reports lines which query has the parameter NAME=VALUE, or NAME for any value. Several --param options can be given. Lines are reported whenever a parameter matches").PlaceHolder("NAME=VALUE").
+		StringsVar(&a.params)
+
+	app.Flag("format", "output FORMAT: csv, jsonl (one JSON object per line), store (compact columnar store, searched faster than logs), sqlite (SQLite database with a table records), elasticsearch (documents sent to the _bulk API of Elasticsearch or OpenSearch), loki (lines pushed to Loki), or splunk (events sent to the Splunk HTTP Event Collector). store and sqlite need --output FILE, elasticsearch, loki and splunk need --output URL").PlaceHolder("FORMAT").
+		EnumVar(&a.format, "csv", "jsonl", "store", "sqlite", "elasticsearch", "loki", "splunk")
+
+	delimiter := ";"
+	app.Flag("delimiter", "CSV fields delimiter, default ';'. Use 'tab' for tabulations").PlaceHolder("CHAR").
+		StringVar(&delimiter)
+
+	header := true
+	app.Flag("header", "write the header line. Use --no-header to omit it").Default("true").BoolVar(&header)
+
+	app.Flag("output", "write the result into FILE instead of the console, or send it to the server URL of the elasticsearch, loki and splunk formats").Short('o').PlaceHolder("FILE").
+		StringVar(&a.output)
+	app.Flag("es-index", "PREFIX of Elasticsearch index names, followed by the date of records, like iislog-2017.01.31").Default("iislog").PlaceHolder("PREFIX").
+		StringVar(&a.esIndex)
+	app.Flag("token", "TOKEN of the Splunk HTTP Event Collector, for the splunk format").PlaceHolder("TOKEN").
+		StringVar(&a.token)
+	app.Flag("checkpoint", "record in FILE the last lines sent to the server of the elasticsearch, loki and splunk formats, and resume after them").PlaceHolder("FILE").
+		StringVar(&a.checkpoint)
+
+	app.Flag("verbose", "report files skipped because they aren't IIS logs").Short('v').BoolVar(&a.verbose)
+	app.Flag("strict", "stop at the first line that can't be parsed, or file that can't be read").BoolVar(&a.strict)
+	app.Flag("rejects", "write lines that can't be parsed into FILE, each one after a comment giving the file, the line number and the error").PlaceHolder("FILE").
+		StringVar(&a.rejects)
+
+	index := true
+	app.Flag("index", "read only the parts of logs that may match, according to index files written by the index command. Use --no-index to read whole logs").
+		Default("true").BoolVar(&index)
+
+	columns := []string{}
+	outputFlags := func(cmd *kingpin.CmdClause) {
+		cmd.Flag("decode", "percent-decode cs-uri-stem and cs-uri-query in the output. In jsonl format, adds query parameters").BoolVar(&a.decode)
+		cmd.Flag("columns", "comma separated list of output COLUMNS: any log field like cs-uri-stem, c-ip or cs(User-Agent), or datetime, status, status-label, site, time-taken(ms)...").PlaceHolder("COLUMNS").
+			StringsVar(&columns)
+	}
+
+	search := app.Command(searchCommand, "lists log lines matching filters, sorted by date").Default()
+	outputFlags(search)
+	search.Arg("file", "file, path, archive, or - for the standard input").Required().StringsVar(&a.files)
+
+	stats := app.Command(statsCommand, "reports count, time taken and bytes statistics of matching lines")
+	stats.Flag("group-by", "groups statistics by FIELD (uri, user, status, s-ip, site, hour...). Several --group-by options can be given").PlaceHolder("FIELD").
+		StringsVar(&a.groupBy)
+	stats.Arg("file", "file, path, archive, or - for the standard input").Required().StringsVar(&a.files)
+
+	tail := app.Command(tailCommand, "follows the current log file of folders, like tail -f, and reports new matching lines")
+	outputFlags(tail)
+	tail.Arg("folder", "folder of IIS log files, or - for the standard input").Required().StringsVar(&a.files)
+
+	metrics := app.Command(metricsCommand, "follows the current log file of folders, like tail, and serves Prometheus metrics of new matching lines on /metrics")
+	metrics.Flag("listen", "listen on ADDRESS").Default(":9180").PlaceHolder("ADDRESS").StringVar(&a.listen)
+	metrics.Arg("folder", "folder of IIS log files").Required().StringsVar(&a.files)
+
+	alert := app.Command(alertCommand, "evaluates the alert rules of a FILE over matching lines, and writes and posts to a webhook a notification when a rule fires, and when it's resolved")
+	alert.Flag("rules", "FILE of alert rules").Required().PlaceHolder("FILE").StringVar(&a.rulesFile)
+	alert.Flag("webhook", "URL where notifications are posted, instead of the webhook of the rules file").PlaceHolder("URL").StringVar(&a.webhook)
+	alert.Flag("follow", "follow the current log file of folders, like tail, instead of reading logs").BoolVar(&a.follow)
+	alert.Flag("lag", "when following, delay of IIS writing lines: windows move with the clock minus DURATION").Default("1m").PlaceHolder("DURATION").DurationVar(&a.lag)
+	alert.Arg("file", "file, path, archive, folder when following, or - for the standard input").Required().StringsVar(&a.files)
+
+	convert := app.Command(convertCommand, "converts matching lines into the store given by --output, or writes all their fields in the format given by --format")
+	outputFlags(convert)
+	convert.Arg("file", "file, path, archive, or - for the standard input").Required().StringsVar(&a.files)
+
+	describe := app.Command(describeCommand, "describes log files: time frame, count of matching lines, servers and fields")
+	describe.Arg("file", "file, path, archive, or - for the standard input").Required().StringsVar(&a.files)
+
+	merge := app.Command(mergeCommand, "merges matching lines of several logs into a single W3C log, sorted by date")
+	merge.Arg("file", "file, path, archive, or - for the standard input").Required().StringsVar(&a.files)
+
+	sql := app.Command(sqlCommand, "loads matching lines into the table records of an in-memory SQLite database, and writes the result of the QUERY")
+	sql.Arg("query", "SQL QUERY, like: SELECT uri, count(*) FROM records WHERE status >= 500 GROUP BY uri").Required().StringVar(&a.sqlQuery)
+	sql.Arg("file", "file, path, archive, or - for the standard input").Required().StringsVar(&a.files)
+
+	serve := app.Command(serveCommand, "serves a web UI and a REST API to search logs of folders")
+	serve.Flag("logs", "FOLDER of IIS log files, path or archive. Several --logs options can be given").PlaceHolder("FOLDER").Required().
+		StringsVar(&a.files)
+	serve.Flag("listen", "listen on ADDRESS").Default("localhost:8080").PlaceHolder("ADDRESS").StringVar(&a.listen)
+
+	indexCmd := app.Command(indexCommand, "writes an index next to each log file or archive, used to skip parts of logs that can't match. Indexes are ignored when files change. Use --no-index to rebuild them")
+	indexCmd.Arg("file", "file, path, or archive").Required().StringsVar(&a.files)
 
 	cmd, err := app.Parse(os.Args[1:])
+	if err != nil {
+		return cmd, err
+	}
+	a.command = cmd
+
+	for _, c := range columns {
+		a.columns = append(a.columns, strings.Split(c, ",")...)
+	}
+	if a.format == "" {
+		a.format = "csv"
+		if cmd == convertCommand {
+			a.format = "store"
+		}
+	}
+	if (a.format == "store" || a.format == "sqlite") && a.output == "" {
+		return cmd, fmt.Errorf("the %s format needs --output FILE", a.format)
+	}
+	if a.sinkFormat() && a.output == "" {
+		return cmd, fmt.Errorf("the %s format needs --output URL", a.format)
+	}
+	if a.format == "splunk" && a.token == "" {
+		return cmd, fmt.Errorf("the splunk format needs --token")
+	}
+	if cmd == sqlCommand {
+		if err = checkSQL(a.sqlQuery); err != nil {
+			return cmd, fmt.Errorf("sql: %w", err)
+		}
+	}
+	if delimiter == "tab" || delimiter == `\t` {
+		delimiter = "\t"
+	}
+	if utf8.RuneCountInString(delimiter) != 1 {
+		return cmd, fmt.Errorf("delimiter must be a single character, got '%s'", delimiter)
+	}
+	a.delimiter, _ = utf8.DecodeRuneInString(delimiter)
+	a.noHeader = !header
+	a.noIndex = !index
 
 	return cmd, err
 
@@ -1,79 +1,188 @@
 package iislog
 
 import (
+	"encoding/csv"
 	"fmt"
-
-	"sync"
-
-	"sort"
+	"io"
+	"net"
 
 	"time"
 
 	"github.com/simulot/golib/pipeline"
+	"github.com/simulot/iislog/expr"
 	"github.com/simulot/iislog/iis"
 )
 
-// DeduplicateOperator creates an operator that remove duplicates
-// from flow, and sort it by date for application's pipeline
-func (a *Application) DeduplicateOperator() pipeline.Operator {
-	lock := sync.RWMutex{}
-	seen := map[string]bool{}
-	records := iis.LogRecords{}
+// rowWriter writes a table of values in the output format
+type rowWriter interface {
+	WriteHeader(columns []string) error
+	WriteRow(values []interface{}) error
+	Flush() error
+}
 
-	return func(in, out chan interface{}) {
-		for i := range in {
-			if item, ok := i.(*iis.LogRecord); ok {
-				lock.RLock()
-				_, dejaVu := seen[item.Raw]
-				lock.RUnlock()
-				if !dejaVu {
-					lock.Lock()
-					seen[item.Raw] = true
-					records = append(records, item)
-					lock.Unlock()
-				}
-			} else {
-				panic("Expecting *iis.LogRecord in pipeline.Operator OutputOperator")
-			}
+// newRowWriter makes a rowWriter for the selected output format
+func (a *Application) newRowWriter(w io.Writer) rowWriter {
+	if a.format == "jsonl" {
+		return newJSONLWriter(w)
+	}
+	c := &csvWriter{w: csv.NewWriter(w), header: !a.noHeader}
+	c.w.Comma = a.delimiter
+	c.w.UseCRLF = true
+	return c
+}
+
+// csvWriter writes RFC 4180 CSV
+type csvWriter struct {
+	w      *csv.Writer
+	header bool // Write the header line
+	record []string
+}
+
+func (c *csvWriter) WriteHeader(columns []string) error {
+	if !c.header {
+		return nil
+	}
+	return c.w.Write(columns)
+}
+
+func (c *csvWriter) WriteRow(values []interface{}) error {
+	c.record = c.record[:0]
+	for _, v := range values {
+		c.record = append(c.record, csvValue(v))
+	}
+	return c.w.Write(c.record)
+}
+
+func (c *csvWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// csvValue formats values for CSV output
+func csvValue(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case time.Time:
+		return t.Format("2006-01-02 15:04:05")
+	case net.IP:
+		if t == nil {
+			return ""
 		}
+	}
+	return fmt.Sprint(v)
+}
 
-		// At this point, we have selected all items
-		sort.Sort(records)
-		for _, item := range records {
-			out <- item
+// defaultColumns are the columns of the listing when --columns isn't given
+var defaultColumns = []string{"datetime", "status", "s-ip", "cs-username", "cs-uri-stem", "cs-uri-query", "time-taken(ms)", "time-taken", "status-label"}
+
+// column is an output column
+type column struct {
+	name  string
+	value func(r *iis.LogRecord) interface{}
+}
+
+// columnField gives the field of a column or a group-by name: a field known by
+// LogRecord.Get, like status (status.substatus), or the W3C name of a short name
+func columnField(name string) string {
+	if iis.IsKnownField(name) {
+		return name
+	}
+	return expr.Field(name)
+}
+
+// makeColumn gives the way to get a column value. Any field known by LogRecord.Get
+// can be used, or its short name, plus time-taken(ms) and query parameters as param(name).
+func (a *Application) makeColumn(name string) column {
+	field := columnField(name)
+	switch field {
+	case "time-taken(ms)":
+		return column{name, func(r *iis.LogRecord) interface{} { return int64(r.TimeTaken / time.Millisecond) }}
+	}
+	return column{name, func(r *iis.LogRecord) interface{} { return a.fieldValue(r, field) }}
+}
+
+// fieldValue gets a record field for output, decoding URI and query when asked
+func (a *Application) fieldValue(r *iis.LogRecord, field string) interface{} {
+	v := r.Get(field)
+	if a.decode && (field == "cs-uri-stem" || field == "cs-uri-query") {
+		return unescape(v.(string))
+	}
+	return v
+}
+
+// logColumns gives the columns of all fields read from the log
+func logColumns(r *iis.LogRecord) []string {
+	names := []string{"datetime"}
+	for _, f := range r.Fields {
+		switch f {
+		case "date", "time":
+			continue
 		}
+		names = append(names, f)
 	}
+	return append(names, "status-label")
+}
+
+// ownOutput tells if the output of the format opens the --output file or URL itself
+func (a *Application) ownOutput() bool {
+	switch a.format {
+	case "store", "sqlite":
+		return true
+	}
+	return a.sinkFormat()
 }
 
 // OutputOperator creates an output for application's pipeline
 func (a *Application) OutputOperator() pipeline.Operator {
-	return func(in, out chan interface{}) {
-		fmt.Print("date;")
-		fmt.Print("status;")
-		fmt.Print("s-ip;")
-		fmt.Print("cs-username;")
-		fmt.Print("cs-uri-stem;")
-		fmt.Print("cs-uri-query;")
-		fmt.Print("time-taken(ms);")
-		fmt.Print("time-taken;")
-		fmt.Print("status-label")
-		fmt.Print("\r\n")
+	if a.format == "jsonl" && len(a.columns) == 0 {
+		return a.jsonlOutputOperator()
+	}
+	switch a.format {
+	case "store":
+		return a.StoreOutputOperator()
+	case "sqlite":
+		return a.SQLiteOutputOperator()
+	case "elasticsearch", "loki", "splunk":
+		return a.sinkOutputOperator()
+	}
+
+	names := a.columns
+	if len(names) == 0 && a.command != convertCommand {
+		names = defaultColumns
+	}
 
+	return func(in, out chan interface{}) {
+		w := a.newRowWriter(a.out)
+		var columns []column
+		var values []interface{}
 		for i := range in {
 			if item, ok := i.(*iis.LogRecord); ok {
-				fmt.Print(item.DateTime.Format(`"2006-01-02 15:04:05"`), ";")
-				fmt.Print(item.Get("status"), ";")
-				fmt.Print(item.Server, ";")
-				fmt.Print(item.User, ";")
-				fmt.Print(item.URI, ";")
-				fmt.Print(`"`, item.Query, `"`, ";")
-				fmt.Print(int(item.Get("time-taken").(time.Duration)/time.Millisecond), ";")
-				fmt.Print(item.Get("time-taken"), ";")
-				fmt.Print(`"`, item.Get("status-label"), `"`)
-				fmt.Print("\r\n")
+				if columns == nil {
+					if len(names) == 0 {
+						// Converts all fields of the first log
+						names = logColumns(item)
+					}
+					for _, n := range names {
+						columns = append(columns, a.makeColumn(n))
+					}
+					values = make([]interface{}, len(columns))
+					w.WriteHeader(names)
+				}
+				for c := range columns {
+					values[c] = columns[c].value(item)
+				}
+				w.WriteRow(values)
+				if a.command == tailCommand {
+					w.Flush()
+				}
 			} else {
 				panic("Expecting *iis.LogRecord in pipeline.Operator OutputOperator")
 			}
 		}
+		if columns == nil && len(names) > 0 {
+			w.WriteHeader(names)
+		}
+		w.Flush()
 	}
 }
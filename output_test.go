@@ -0,0 +1,75 @@
+package iislog
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCSV(t *testing.T) {
+	log := "#Date: 2017-01-31 09:00:00\r\n" +
+		"#Fields: date time cs-uri-stem cs-uri-query sc-status sc-substatus time-taken X-Forwarded-For cs(User-Agent)\r\n" +
+		"2017-01-31 09:08:40 /app/a id=1;2 500 19 2246 10.0.0.1 Mozilla/5.0+\"quoted\"\r\n" +
+		"2017-01-31 09:08:41 /app/b id=3 200 0 15 - curl\r\n"
+
+	tests := []struct {
+		name      string
+		columns   []string
+		delimiter rune
+		noHeader  bool
+		expected  string
+	}{
+		{"quoting", []string{"uri", "query", "agent"}, ';', false,
+			"uri;query;agent\r\n" +
+				"/app/a;\"id=1;2\";\"Mozilla/5.0 \"\"quoted\"\"\"\r\n" +
+				"/app/b;id=3;curl\r\n"},
+		{"delimiter", []string{"uri", "query"}, ',', false,
+			"uri,query\r\n/app/a,id=1;2\r\n/app/b,id=3\r\n"},
+		{"tab without header", []string{"uri", "status"}, '\t', true,
+			"/app/a\t500.19\r\n/app/b\t200.0\r\n"},
+		{"other, derived and param fields", []string{"X-Forwarded-For", "status", "sc-status", "status-label", "site", "hour", "time-taken(ms)", "time-taken", "param(id)"}, ';', true,
+			"10.0.0.1;500.19;500;Configuration data is invalid;/app;2017-01-31 09:00;2246;2.246s;\"1;2\"\r\n" +
+				"-;200.0;200;OK. The client request has succeeded;/app;2017-01-31 09:00;15;15ms;3\r\n"},
+	}
+	for _, tt := range tests {
+		a := NewApplication()
+		a.columns = tt.columns
+		a.delimiter = tt.delimiter
+		a.noHeader = tt.noHeader
+		b := bytes.NewBuffer(nil)
+		a.SetOutput(b)
+		if err := a.RunReaders(NamedReader{Name: "u_ex170131.log", Reader: strings.NewReader(log)}); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != tt.expected {
+			t.Errorf("%s: expecting\n%q\ngot\n%q", tt.name, tt.expected, b.String())
+		}
+	}
+}
+
+// TestColumnGroupBy checks columns and group-by fields give the same values
+func TestColumnGroupBy(t *testing.T) {
+	log := "#Date: 2017-01-31 09:00:00\r\n" +
+		"#Fields: date time cs-uri-stem sc-status sc-substatus time-taken\r\n" +
+		"2017-01-31 09:08:40 /a 500 19 10\r\n"
+	for _, field := range []string{"status", "sc-status", "uri", "hour", "status-label"} {
+		run := func(a *Application) string {
+			a.noHeader = true
+			b := bytes.NewBuffer(nil)
+			a.SetOutput(b)
+			if err := a.RunReaders(NamedReader{Name: "u_ex170131.log", Reader: strings.NewReader(log)}); err != nil {
+				t.Fatal(err)
+			}
+			return strings.SplitN(b.String(), ";", 2)[0]
+		}
+		a := NewApplication()
+		a.columns = []string{field}
+		column := strings.TrimSuffix(run(a), "\r\n")
+		a = NewApplication()
+		a.command = statsCommand
+		a.groupBy = []string{field}
+		if group := run(a); group != column {
+			t.Errorf("%s: column gives %q, group-by gives %q", field, column, group)
+		}
+	}
+}
@@ -1,38 +1,80 @@
 package iislog
 
 import (
+	"context"
 	"time"
 
 	"strings"
 
-	"github.com/simulot/golib/file/walker"
 	"github.com/simulot/golib/pipeline"
 	"github.com/simulot/iislog/iis"
 )
 
 // ParserOperator create a operator for the pipeline in charge of
-// opening the log parser and output matched lines
+// making a stream of records for each log file. The parsing is deferred
+// until the stream is opened by the MergeOperator.
 func (a *Application) ParserOperator() pipeline.Operator {
 	filter := a.MakeLogRecordFilter()
 
 	return func(in, out chan interface{}) {
 		for i := range in {
-			if item, ok := i.(walker.WalkItem); ok {
-				if r, err := item.Reader(); err == nil {
-					p := iis.NewLogParser(r)
-					recChan := p.Parse(filter)
-					for rec := range recChan {
-						out <- rec
-					}
-				}
-				item.Close()
+			if file, ok := i.(*logFile); ok {
+				out <- &recordStream{ctx: a.context(), errs: a.errs, file: file, filter: filter, mayMatch: a.mayMatch}
 			} else {
-				panic("Expecting walker.WalkItem in pipeline.Operator filter")
+				panic("Expecting *logFile in pipeline.Operator ParserOperator")
 			}
 		}
 	}
 }
 
+// recordStream is the flow of records parsed from one log file
+type recordStream struct {
+	ctx      context.Context // Stops the parsing when done
+	errs     *parseErrors    // Where parse errors are reported
+	file     *logFile
+	filter   iis.RecordFilter
+	mayMatch func(*blockIndex) bool // Tells if a block of a store may match, nil for all
+	records  chan *iis.LogRecord
+	head     *iis.LogRecord // Next record of the stream
+}
+
+// open starts the parsing of the log file
+func (s *recordStream) open() {
+	r, err := s.file.open()
+	switch {
+	case err == nil && s.file.store:
+		s.records = s.storeRecords(r)
+	case err == nil && s.file.blocks != nil:
+		// Only blocks that may match, according to the index
+		s.records = s.blockRecords(r, s.file.blocks)
+	case err == nil:
+		p := iis.NewLogParser(r)
+		p.SetSource(s.file.item.Source())
+		p.SetErrorHandler(s.errs.add)
+		s.records = p.ParseContext(s.ctx, s.filter)
+	default:
+		s.errs.report(s.file.item, err)
+		s.records = make(chan *iis.LogRecord)
+		close(s.records)
+	}
+}
+
+// next reads the next record of the stream into head.
+// It returns false and closes the file at the end of the stream.
+func (s *recordStream) next() bool {
+	var ok bool
+	s.head, ok = <-s.records
+	if !ok {
+		s.file.close()
+	}
+	return ok
+}
+
+// close stops the stream before its end. The parsing ends as the context is done.
+func (s *recordStream) close() {
+	s.file.close()
+}
+
 type filter struct {
 	a *Application
 }
@@ -69,6 +111,29 @@ func (f *filter) CheckField(field string, value interface{}) (ret bool) {
 			}
 		}
 	}
+	if ret && len(f.a.params) > 0 && field == "cs-uri-query" {
+		ret = false
+		query := value.(string)
+		if i := strings.IndexByte(query, '|'); i >= 0 {
+			// Drop Classic ASP error details
+			query = query[:i]
+		}
+		params := iis.ParseQuery(query)
+		for _, p := range f.a.params {
+			name, want := p, ""
+			if i := strings.IndexByte(p, '='); i >= 0 {
+				name, want = p[:i], p[i+1:]
+			}
+			if values, ok := params[name]; ok {
+				for _, v := range values {
+					if v == want || want == "" {
+						ret = true
+						break
+					}
+				}
+			}
+		}
+	}
 	if ret && len(f.a.users) > 0 && field == "cs-username" {
 		ret = false
 		for _, u := range f.a.users {
@@ -78,6 +143,9 @@ func (f *filter) CheckField(field string, value interface{}) (ret bool) {
 			}
 		}
 	}
+	if ret && f.a.where != nil {
+		ret = f.a.where.CheckField(field, value)
+	}
 	return
 }
 
@@ -85,6 +153,16 @@ func (f *filter) CheckError(status, substatus int) bool {
 	if f.a.protocolError && status != 0 && (status < 400 || status >= 600 || (status == 401 && substatus == 2)) {
 		return false
 	}
+	if f.a.where != nil {
+		return f.a.where.CheckError(status, substatus)
+	}
+	return true
+}
+
+func (f *filter) CheckRecord(r *iis.LogRecord) bool {
+	if f.a.where != nil {
+		return f.a.where.CheckRecord(r)
+	}
 	return true
 }
 
@@ -0,0 +1,201 @@
+package iislog
+
+import (
+	"context"
+	"io/fs"
+	"iter"
+	"time"
+
+	"github.com/simulot/iislog/expr"
+	"github.com/simulot/iislog/iis"
+)
+
+// Query describes what is searched in IIS logs: where the logs are, and which
+// records are reported. It's built with chained methods, like:
+//
+//	q := iislog.NewQuery("Logs-IIS/*.zip").Since(24 * time.Hour).Errors().Where("time-taken > 2s")
+//
+// Errors met while building the query are reported by Search.
+type Query struct {
+	files            []string      // Files, paths, archives to be explored
+	items            []interface{} // Logs given by readers or file systems
+	dateFrom, dateTo time.Time     // Set exploration time limits
+	protocolError    bool          // indicates to filter 4xx and 5xx errors
+	hideAssets       bool          // indicate to filer gif, png, css, js
+	longQueries      time.Duration // search queries longer than this
+	urls             []string      // URL to be reported. Cumulative.
+	users            []string      // List of user concerned. Cumulative
+	where            *expr.Expr    // Filter expression
+	params           []string      // Query parameters to be reported, like name=value. Cumulative
+	strict           bool          // Stop at the first line that can't be parsed
+	noIndex          bool          // Ignore index files
+	err              error         // First error met while building the query
+}
+
+// NewQuery creates a query on files, paths or archives, that reports all records
+func NewQuery(files ...string) *Query {
+	return &Query{
+		files:    files,
+		dateFrom: time.Date(1900, 01, 01, 00, 0, 0, 0, time.UTC),
+		dateTo:   time.Date(9999, 12, 31, 23, 59, 59, 999999999, time.UTC),
+	}
+}
+
+// Files adds files, paths or archives to be explored. Wild cards are accepted.
+func (q *Query) Files(files ...string) *Query {
+	q.files = append(q.files, files...)
+	return q
+}
+
+// FS adds the logs of the file system fsys matching patterns, like fs.Glob patterns.
+// Folders are explored recursively.
+func (q *Query) FS(fsys fs.FS, patterns ...string) *Query {
+	items, err := fsItems(fsys, patterns...)
+	if err != nil && q.err == nil {
+		q.err = err
+	}
+	q.items = append(q.items, items...)
+	return q
+}
+
+// Readers adds logs given by readers
+func (q *Query) Readers(readers ...NamedReader) *Query {
+	q.items = append(q.items, readerItems(readers...)...)
+	return q
+}
+
+// From reports records logged after t
+func (q *Query) From(t time.Time) *Query {
+	q.dateFrom = t.UTC()
+	return q
+}
+
+// To reports records logged before t
+func (q *Query) To(t time.Time) *Query {
+	q.dateTo = t.UTC()
+	return q
+}
+
+// Since reports records logged during the last duration d
+func (q *Query) Since(d time.Duration) *Query {
+	return q.From(time.Now().Add(-d))
+}
+
+// Errors reports only protocol errors (4xx and 5xx)
+func (q *Query) Errors() *Query {
+	q.protocolError = true
+	return q
+}
+
+// HideAssets hides static files (html, gif, ico, css, jpg, png, js)
+func (q *Query) HideAssets() *Query {
+	q.hideAssets = true
+	return q
+}
+
+// LongerThan reports queries taking more than d
+func (q *Query) LongerThan(d time.Duration) *Query {
+	q.longQueries = d
+	return q
+}
+
+// URL reports records which URI contains one of urls
+func (q *Query) URL(urls ...string) *Query {
+	q.urls = append(q.urls, urls...)
+	return q
+}
+
+// User reports records of one of users
+func (q *Query) User(users ...string) *Query {
+	q.users = append(q.users, users...)
+	return q
+}
+
+// Param reports records which query has one of the parameters, given like
+// name=value, or name for any value
+func (q *Query) Param(params ...string) *Query {
+	q.params = append(q.params, params...)
+	return q
+}
+
+// Where reports records matching the expression, like: status >= 500 && time-taken > 2s
+func (q *Query) Where(expression string) *Query {
+	where, err := expr.Compile(expression)
+	if err != nil {
+		if q.err == nil {
+			q.err = err
+		}
+		return q
+	}
+	q.where = where
+	return q
+}
+
+// Strict stops the search at the first line that can't be parsed, or file that can't be read
+func (q *Query) Strict() *Query {
+	q.strict = true
+	return q
+}
+
+// NoIndex reads whole log files, ignoring index files written by the index command
+func (q *Query) NoIndex() *Query {
+	q.noIndex = true
+	return q
+}
+
+// Search runs the query and gives matching records sorted by date. The search
+// stops when the context is done, and its error is given. Lines that can't be
+// parsed are given as *iis.ParseError at the end of the search, only the first
+// ones are given. In strict mode, the search stops at the first one.
+func Search(ctx context.Context, q *Query) iter.Seq2[*iis.LogRecord, error] {
+	return func(yield func(*iis.LogRecord, error) bool) {
+		if q.err != nil {
+			yield(nil, q.err)
+			return
+		}
+		// The pipeline is stopped when the search is stopped early, or by the first error in strict mode
+		pipeCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		a := &Application{Query: *q, ctx: pipeCtx}
+		a.errs = newParseErrors(q.strict, cancel, nil)
+		in := make(chan interface{})
+		go func() {
+			for _, source := range a.sources() {
+				in <- source
+			}
+			close(in)
+		}()
+		out := a.parseFlow(a.MergeOperator()).Run(in)
+
+		for {
+			if err := ctx.Err(); err != nil {
+				yield(nil, err)
+				return
+			}
+			select {
+			case <-ctx.Done():
+				yield(nil, ctx.Err())
+				return
+			case i, ok := <-out:
+				if !ok {
+					a.errs.Lock()
+					errs := a.errs.errors
+					a.errs.Unlock()
+					if q.strict && len(errs) > 1 {
+						// Other files may have met errors before being stopped
+						errs = errs[:1]
+					}
+					for _, err := range errs {
+						if !yield(nil, err) {
+							return
+						}
+					}
+					return
+				}
+				if !yield(i.(*iis.LogRecord), nil) {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package iislog
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	q := NewQuery().
+		Readers(
+			NamedReader{Name: "server1.log", Reader: strings.NewReader(sourceLog1)},
+			NamedReader{Name: "server2.log", Reader: strings.NewReader(sourceLog2)},
+		).
+		Where("status >= 400")
+	uris := []string{}
+	for r, err := range Search(context.Background(), q) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		uris = append(uris, r.URI)
+	}
+	if strings.Join(uris, ",") != "/b,/c" {
+		t.Errorf("Expecting /b,/c, got %v", uris)
+	}
+
+	// Stop early
+	q = NewQuery().Readers(NamedReader{Name: "server1.log", Reader: strings.NewReader(sourceLog1)})
+	count := 0
+	for range Search(context.Background(), q) {
+		count++
+		break
+	}
+	if count != 1 {
+		t.Errorf("Expecting 1 record, got %d", count)
+	}
+}
+
+func TestSearchErrors(t *testing.T) {
+	for _, err := range Search(context.Background(), NewQuery().Where("status >")) {
+		if err == nil {
+			t.Errorf("Expecting an error for an invalid expression")
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	q := NewQuery().Readers(NamedReader{Name: "server1.log", Reader: strings.NewReader(sourceLog1)})
+	var err error
+	for _, err = range Search(ctx, q) {
+	}
+	if err != context.Canceled {
+		t.Errorf("Expecting context.Canceled, got %v", err)
+	}
+}
+
+func TestSearchParseErrors(t *testing.T) {
+	bad := sourceLog1 + "2017-01-31 09:11:00 /d abc\r\n2017-01-31 09:12:00 /e 200 extra\r\n"
+	for _, strict := range []bool{false, true} {
+		q := NewQuery().Readers(NamedReader{Name: "u_ex170131.log", Reader: strings.NewReader(bad)})
+		if strict {
+			q.Strict()
+		}
+		errs := []string{}
+		for _, err := range Search(context.Background(), q) {
+			if err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+		expected := []string{
+			`u_ex170131.log:6: sc-status: strconv.Atoi: parsing "abc": invalid syntax`,
+			`u_ex170131.log:7: 5 values for 4 fields`,
+		}
+		if strict {
+			expected = expected[:1]
+		}
+		if strings.Join(errs, "\n") != strings.Join(expected, "\n") {
+			t.Errorf("Strict %v: expecting %v, got %v", strict, expected, errs)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package iislog
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/simulot/golib/pipeline"
+	"github.com/simulot/iislog/expr"
+	"github.com/simulot/iislog/iis"
+)
+
+// webUI is the web page served by the serve command
+//
+//go:embed web
+var webUI embed.FS
+
+// serve runs the HTTP server of the serve command, until Ctrl-C
+func (a *Application) serve() error {
+	ctx, stop := signal.NotifyContext(a.context(), os.Interrupt)
+	defer stop()
+	srv := &http.Server{
+		Addr:    a.listen,
+		Handler: a.serveHandler(),
+		// Ctrl-C stops searches in progress
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+	fmt.Fprintf(os.Stderr, "Serving %s on http://%s/\n", strings.Join(a.files, ", "), a.listen)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// serveHandler gives the handler of the web UI and the REST API:
+//
+//	GET /api/search   matching records, with the same filters as the command line
+//	GET /api/stats    statistics of matching records, grouped by group-by fields
+//	GET /api/fields   fields known by columns, group-by and where expressions
+func (a *Application) serveHandler() http.Handler {
+	mux := http.NewServeMux()
+	ui, _ := fs.Sub(webUI, "web")
+	mux.Handle("/", http.FileServer(http.FS(ui)))
+	mux.HandleFunc("/api/search", a.handleCommand(searchCommand))
+	mux.HandleFunc("/api/stats", a.handleCommand(statsCommand))
+	mux.HandleFunc("/api/fields", handleFields)
+	return mux
+}
+
+// handleCommand runs the command with the filters given by request parameters,
+// and streams its result. The run stops when the client goes away.
+func (a *Application) handleCommand(command string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			httpError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		ra, err := a.requestApplication(command, r.URL.Query())
+		if err != nil {
+			httpError(w, http.StatusBadRequest, err)
+			return
+		}
+		if ra.format == "csv" {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+		}
+		// The count of errors is known at the end of the stream
+		w.Header().Set("Trailer", parseErrorsTrailer)
+		ra.ctx = r.Context()
+		out := &flushWriter{w: w}
+		ra.out = out
+		err = ra.runContext(ra.sources(), io.Discard)
+		if err != nil && !out.written {
+			httpError(w, http.StatusInternalServerError, err)
+			return
+		}
+		ra.writeSummary(w, err)
+	}
+}
+
+// parseErrorsTrailer is the trailer giving the count of errors met while reading logs
+const parseErrorsTrailer = "Iislog-Parse-Errors"
+
+// writeSummary tells the client the result is incomplete: the trailer gives the
+// count of parse errors and, in jsonl, a last object gives them with the error
+// which stopped the command, like
+//
+//	{"parse_errors":2,"errors":["u_ex170131.log: line 3: ..."],"error":"..."}
+func (a *Application) writeSummary(w http.ResponseWriter, err error) {
+	count, errors := 0, []*iis.ParseError(nil)
+	if a.errs != nil {
+		count, errors = a.errs.reported()
+	}
+	w.Header().Set(parseErrorsTrailer, strconv.Itoa(count))
+	if a.format == "csv" || (count == 0 && err == nil) {
+		return
+	}
+	summary := struct {
+		ParseErrors int      `json:"parse_errors"`
+		Errors      []string `json:"errors,omitempty"`
+		Error       string   `json:"error,omitempty"`
+	}{ParseErrors: count}
+	for _, pe := range errors {
+		summary.Errors = append(summary.Errors, pe.Error())
+	}
+	if err != nil {
+		summary.Error = err.Error()
+	}
+	json.NewEncoder(w).Encode(summary)
+}
+
+// handleFields lists fields known by columns, group-by and where expressions
+func handleFields(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"fields":  iis.KnownFields,
+		"aliases": expr.Aliases(),
+	})
+}
+
+// httpError writes an error as a JSON object
+func httpError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// requestApplication makes the application running a command on the logs of
+// the server, with the filters given by request parameters, named after command
+// line flags: from, to, since, errors, hide-assets, long-queries, url, user, param,
+// where, columns, group-by, format (jsonl by default, or csv), decode and limit.
+func (a *Application) requestApplication(command string, params url.Values) (*Application, error) {
+	ra := NewApplication()
+	ra.command = command
+	ra.files = a.files
+	ra.noIndex = a.noIndex
+	ra.format = "jsonl"
+	for name, values := range params {
+		value := values[len(values)-1]
+		if value == "" {
+			// Empty fields of the form
+			continue
+		}
+		var err error
+		switch name {
+		case "from", "to":
+			var t time.Time
+			if t, err = parseRequestTime(value); err == nil {
+				if name == "from" {
+					ra.From(t)
+				} else {
+					ra.To(t)
+				}
+			}
+		case "since":
+			var d time.Duration
+			if d, err = time.ParseDuration(value); err == nil {
+				ra.Since(d)
+			}
+		case "errors":
+			if requestBool(value) {
+				ra.Errors()
+			}
+		case "hide-assets":
+			if requestBool(value) {
+				ra.HideAssets()
+			}
+		case "long-queries":
+			var d time.Duration
+			if d, err = time.ParseDuration(value); err == nil {
+				ra.LongerThan(d)
+			}
+		case "url":
+			ra.URL(nonEmpty(values)...)
+		case "user":
+			ra.User(nonEmpty(values)...)
+		case "param":
+			ra.Param(nonEmpty(values)...)
+		case "where":
+			ra.Where(value)
+		case "columns":
+			for _, v := range nonEmpty(values) {
+				ra.columns = append(ra.columns, strings.Split(v, ",")...)
+			}
+		case "group-by":
+			for _, v := range nonEmpty(values) {
+				ra.groupBy = append(ra.groupBy, strings.Split(v, ",")...)
+			}
+		case "format":
+			if value != "csv" && value != "jsonl" {
+				err = fmt.Errorf("format must be csv or jsonl, got '%s'", value)
+			}
+			ra.format = value
+		case "decode":
+			ra.decode = requestBool(value)
+		case "limit":
+			ra.limit, err = strconv.Atoi(value)
+		default:
+			err = fmt.Errorf("unknown parameter")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return ra, ra.err
+}
+
+// requestTimeFormats are accepted formats of from and to parameters, UTC
+var requestTimeFormats = []string{timeValueFormat, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02", time.RFC3339}
+
+func parseRequestTime(s string) (t time.Time, err error) {
+	for _, f := range requestTimeFormats {
+		if t, err = time.ParseInLocation(f, s, time.UTC); err == nil {
+			return t, nil
+		}
+	}
+	return t, err
+}
+
+func requestBool(s string) bool {
+	b, err := strconv.ParseBool(s)
+	return b || (err != nil && s == "on")
+}
+
+func nonEmpty(values []string) []string {
+	l := []string{}
+	for _, v := range values {
+		if v != "" {
+			l = append(l, v)
+		}
+	}
+	return l
+}
+
+// flushWriter sends what is written to the client at once
+type flushWriter struct {
+	w       http.ResponseWriter
+	written bool // Something was sent
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	f.written = true
+	n, err := f.w.Write(p)
+	if fl, ok := f.w.(http.Flusher); ok {
+		fl.Flush()
+	}
+	return n, err
+}
+
+// limitOperator creates an operator passing the first records, up to the limit
+// of the application, then stopping the pipeline
+func (a *Application) limitOperator(stop func()) pipeline.Operator {
+	return func(in, out chan interface{}) {
+		n := 0
+		for i := range in {
+			if n < a.limit {
+				out <- i
+				n++
+				if n == a.limit {
+					stop()
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package iislog
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServe(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "u_ex170131.log"), []byte(sourceLog1+"2017-01-31 09:11:00 /d 200\r\n"), 0644)
+	a := NewApplication()
+	a.files = []string{dir}
+	srv := httptest.NewServer(a.serveHandler())
+	defer srv.Close()
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	tests := []struct {
+		path     string
+		status   int
+		expected string
+	}{
+		{"/api/search?columns=uri,status&where=status+>=+500", 200, `{"uri":"/c","status":"500.0"}` + "\n"},
+		{"/api/search?columns=uri&format=csv&limit=2", 200, "uri\r\n/a\r\n/c\r\n"},
+		{"/api/search?columns=uri&to=2017-01-31T09:09&from=&errors=", 200, `{"uri":"/a"}` + "\n"},
+		{"/api/stats?group-by=status&format=csv&errors=on", 200, "status;count;time-taken-sum(ms);time-taken-avg(ms);time-taken-min(ms);time-taken-max(ms);time-taken-p50(ms);time-taken-p95(ms);time-taken-p99(ms);sc-bytes-sum;sc-bytes-avg;sc-bytes-min;sc-bytes-max;sc-bytes-p50;sc-bytes-p95;sc-bytes-p99\r\n500.0;1;0;0;0;0;0;0;0;0;0;0;0;0;0;0\r\n"},
+		{"/api/search?where=status+>>+5", 400, ""},
+		{"/api/search?color=blue", 400, `{"error":"color: unknown parameter"}` + "\n"},
+	}
+	for _, tt := range tests {
+		status, body := get(tt.path)
+		if status != tt.status || (tt.expected != "" && body != tt.expected) {
+			t.Errorf("%s: expecting %d %q, got %d %q", tt.path, tt.status, tt.expected, status, body)
+		}
+	}
+
+	status, body := get("/api/fields")
+	fields := struct{ Fields []string }{}
+	if err := json.Unmarshal([]byte(body), &fields); status != 200 || err != nil || len(fields.Fields) == 0 {
+		t.Errorf("/api/fields: expecting fields, got %d %q", status, body)
+	}
+	if status, body = get("/"); status != 200 || !strings.Contains(body, "<form") {
+		t.Errorf("/: expecting the web UI, got %d", status)
+	}
+}
+
+func TestServeParseErrors(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "u_ex170131.log"), []byte(sourceLog1+"2017-01-31 09:11:00 /d 200 extra\r\n"), 0644)
+	a := NewApplication()
+	a.files = []string{dir}
+	srv := httptest.NewServer(a.serveHandler())
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		path     string
+		expected string
+	}{
+		{"/api/search?columns=uri", `{"uri":"/a"}` + "\n" + `{"uri":"/c"}` + "\n" + `{"parse_errors":1,"errors":["` + filepath.Join(dir, "u_ex170131.log") + `:6: 5 values for 4 fields"]}` + "\n"},
+		{"/api/search?columns=uri&format=csv", "uri\r\n/a\r\n/c\r\n"},
+	} {
+		resp, err := http.Get(srv.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != tt.expected {
+			t.Errorf("%s: expecting %q, got %q", tt.path, tt.expected, b)
+		}
+		if n := resp.Trailer.Get(parseErrorsTrailer); n != "1" {
+			t.Errorf("%s: expecting 1 parse error in trailer, got %q", tt.path, n)
+		}
+	}
+}
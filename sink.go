@@ -0,0 +1,339 @@
+package iislog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/simulot/golib/pipeline"
+	"github.com/simulot/iislog/iis"
+)
+
+// Sinks send records to log servers over HTTP, by batches
+const (
+	sinkBatchSize     = 1000        // Records sent at once
+	sinkFlushInterval = time.Second // Delay after which pending records are sent
+	sinkAttempts      = 5           // Attempts to send a batch
+)
+
+// sinkBackoff is the delay before sending a batch again, doubled at each attempt
+var sinkBackoff = time.Second
+
+// sinkHTTP is the HTTP client of sinks
+var sinkHTTP = &http.Client{Timeout: 30 * time.Second}
+
+// sinkClient is the protocol of a log server
+type sinkClient interface {
+	// request makes the request sending a batch of records
+	request(records []*iis.LogRecord) (*http.Request, error)
+	// check reads a successful response. It gives the records refused for a
+	// transient reason, to be sent again, and the errors of records rejected.
+	check(resp *http.Response, records []*iis.LogRecord) (retry []*iis.LogRecord, rejected []*iis.ParseError)
+}
+
+// sinkStatusError is an unsuccessful response of a log server
+type sinkStatusError struct {
+	status string
+	code   int
+	body   string
+}
+
+func (e *sinkStatusError) Error() string {
+	if e.body == "" {
+		return e.status
+	}
+	return e.status + ": " + e.body
+}
+
+// transient tells if sending again may succeed
+func transient(err error) bool {
+	var se *sinkStatusError
+	if errors.As(err, &se) {
+		return se.code == http.StatusTooManyRequests || se.code >= 500
+	}
+	return true
+}
+
+// sink batches records, and sends them with a sinkClient
+type sink struct {
+	client     sinkClient
+	server     string          // Log server, for errors
+	errs       *parseErrors    // Where errors are reported
+	done       <-chan struct{} // Stops waiting before sending again
+	checkpoint *sinkCheckpoint // Last lines sent, nil when not asked
+	records    []*iis.LogRecord
+	failed     bool // A batch couldn't be sent
+	dropped    int  // Records not sent after the failure
+}
+
+// add adds a record to the batch, and sends the batch when it's full.
+// Records already sent according to the checkpoint are ignored.
+func (s *sink) add(r *iis.LogRecord) {
+	if s.checkpoint.sent(r) {
+		return
+	}
+	if s.failed {
+		s.dropped++
+		return
+	}
+	s.records = append(s.records, r)
+	if len(s.records) >= sinkBatchSize {
+		s.flush()
+	}
+}
+
+// flush sends the batch. A batch that can't be sent stops the application, so
+// the checkpoint stays on the last batch sent.
+func (s *sink) flush() {
+	if len(s.records) == 0 {
+		return
+	}
+	defer func() { s.records = s.records[:0] }()
+	if err := s.send(s.records); err != nil {
+		s.fail(&iis.ParseError{File: s.server, Err: err})
+		return
+	}
+	if err := s.checkpoint.advance(s.records); err != nil {
+		s.fail(&iis.ParseError{File: s.checkpoint.file, Err: err})
+	}
+}
+
+// fail stops the application after an error
+func (s *sink) fail(pe *iis.ParseError) {
+	s.failed = true
+	s.dropped += len(s.records)
+	s.errs.fail(pe)
+}
+
+// close sends pending records, and tells how many records weren't sent after a failure
+func (s *sink) close() {
+	s.flush()
+	if s.failed {
+		s.errs.add(&iis.ParseError{File: s.server, Err: fmt.Errorf("%d records not sent", s.dropped)})
+	}
+}
+
+// send sends records, again after transient failures
+func (s *sink) send(records []*iis.LogRecord) error {
+	delay := sinkBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := s.post(records)
+		if err == nil && len(retry) == 0 {
+			return nil
+		}
+		if err != nil && !transient(err) {
+			return err
+		}
+		if err == nil {
+			records = retry
+			err = fmt.Errorf("%d records refused", len(retry))
+		}
+		if attempt == sinkAttempts {
+			return fmt.Errorf("%w, after %d attempts", err, attempt)
+		}
+		select {
+		case <-s.done:
+			return fmt.Errorf("%w, stopped", err)
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// post sends records once
+func (s *sink) post(records []*iis.LogRecord) ([]*iis.LogRecord, error) {
+	req, err := s.client.request(records)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := sinkHTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, &sinkStatusError{status: resp.Status, code: resp.StatusCode, body: strings.TrimSpace(string(b))}
+	}
+	retry, rejected := s.client.check(resp, records)
+	for _, pe := range rejected {
+		s.errs.add(pe)
+	}
+	return retry, nil
+}
+
+// sinkCheckpoint is the last line sent of each log, saved after each batch
+// so a new run resumes after it
+type sinkCheckpoint struct {
+	file  string
+	Lines map[string]int `json:"lines"` // Last line sent, by absolute log path and archive member
+	keys  map[string]string
+}
+
+// loadCheckpoint reads the checkpoint file, if it exists
+func loadCheckpoint(file string) (*sinkCheckpoint, error) {
+	c := &sinkCheckpoint{file: file, Lines: map[string]int{}, keys: map[string]string{}}
+	b, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	if c.Lines == nil {
+		c.Lines = map[string]int{}
+	}
+	return c, nil
+}
+
+// key gives the key of the log of a record
+func (c *sinkCheckpoint) key(r *iis.LogRecord) string {
+	k, ok := c.keys[r.File+"\x00"+r.Member]
+	if !ok {
+		k = r.File
+		if abs, err := filepath.Abs(r.File); err == nil && r.File != "-" {
+			k = abs
+		}
+		if r.Member != "" {
+			k += "[" + r.Member + "]"
+		}
+		c.keys[r.File+"\x00"+r.Member] = k
+	}
+	return k
+}
+
+// line gives the last line sent of a log file, 0 when none
+func (c *sinkCheckpoint) line(file string) int {
+	return c.Lines[c.key(&iis.LogRecord{File: file})]
+}
+
+// sent tells if the record has been sent by a previous batch
+func (c *sinkCheckpoint) sent(r *iis.LogRecord) bool {
+	if c == nil {
+		return false
+	}
+	line, ok := c.Lines[c.key(r)]
+	return ok && r.Line <= line
+}
+
+// advance records the lines of a batch, and saves the checkpoint
+func (c *sinkCheckpoint) advance(records []*iis.LogRecord) error {
+	if c == nil {
+		return nil
+	}
+	for _, r := range records {
+		if k := c.key(r); r.Line > c.Lines[k] {
+			c.Lines[k] = r.Line
+		}
+	}
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Replaces the file at once, so an interrupted run leaves a valid checkpoint
+	tmp := c.file + ".tmp"
+	if err = os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.file)
+}
+
+// sinkEndpoint gives the URL of the API path of a server, unless the server URL is already the API one
+func sinkEndpoint(server, path string) string {
+	server = strings.TrimSuffix(server, "/")
+	if strings.HasSuffix(server, path) {
+		return server
+	}
+	return server + path
+}
+
+// recordLine formats records as JSON objects, like the jsonl format
+type recordLine struct {
+	object func(*iis.LogRecord) ([]string, []interface{})
+	b      bytes.Buffer
+	w      *jsonlWriter
+}
+
+func newRecordLine(object func(*iis.LogRecord) ([]string, []interface{})) *recordLine {
+	l := &recordLine{object: object}
+	l.w = newJSONLWriter(&l.b)
+	return l
+}
+
+// format gives the JSON object of a record, without new line. It's valid until the next call.
+func (l *recordLine) format(r *iis.LogRecord) ([]byte, error) {
+	l.b.Reset()
+	if err := l.w.writeObject(l.object(r)); err != nil {
+		return nil, err
+	}
+	if err := l.w.Flush(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(l.b.Bytes(), []byte("\n")), nil
+}
+
+// sinkFormat tells if the output format sends records to the server given by --output
+func (a *Application) sinkFormat() bool {
+	switch a.format {
+	case "elasticsearch", "loki", "splunk":
+		return true
+	}
+	return false
+}
+
+// newSinkClient makes the client of the server of the output format
+func (a *Application) newSinkClient() sinkClient {
+	switch a.format {
+	case "loki":
+		return newLokiClient(a.output, a.recordObject)
+	case "splunk":
+		return newSplunkClient(a.output, a.token, a.recordObject)
+	}
+	return newElasticsearchClient(a.output, a.esIndex)
+}
+
+// sinkOutputOperator creates an output sending records to a log server by batches.
+// Pending records are sent every second, for followed logs.
+func (a *Application) sinkOutputOperator() pipeline.Operator {
+	return func(in, out chan interface{}) {
+		s := &sink{client: a.newSinkClient(), server: a.output, errs: a.errs, done: a.context().Done()}
+		if a.checkpoint != "" {
+			var err error
+			if s.checkpoint, err = loadCheckpoint(a.checkpoint); err != nil {
+				a.errs.fail(&iis.ParseError{File: a.checkpoint, Err: err})
+				for range in {
+					// Until the pipeline stops
+				}
+				return
+			}
+		}
+		ticker := time.NewTicker(sinkFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case i, ok := <-in:
+				if !ok {
+					s.close()
+					return
+				}
+				item, ok := i.(*iis.LogRecord)
+				if !ok {
+					panic("Expecting *iis.LogRecord in pipeline.Operator sinkOutputOperator")
+				}
+				s.add(item)
+			case <-ticker.C:
+				s.flush()
+			}
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package iislog
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+
+	"github.com/simulot/golib/file/walker"
+	"github.com/simulot/golib/pipeline"
+)
+
+// NewApplication creates an application with default settings: search all records
+// and write them as CSV on the console. It's the entry point to use iislog as a library.
+func NewApplication() *Application {
+	return &Application{
+		Query:     *NewQuery(),
+		command:   searchCommand,
+		format:    "csv",
+		delimiter: ';',
+	}
+}
+
+// SetOutput sets where results are written, instead of the console
+func (a *Application) SetOutput(w io.Writer) {
+	a.out = w
+}
+
+// NamedReader is a log read from a reader, like a log held in memory.
+// The name is reported by the describe command and gives the date of the
+// log when it follows IIS naming schemes.
+type NamedReader struct {
+	Name   string
+	Reader io.Reader
+}
+
+// RunReaders runs the application on logs given by readers instead of files.
+// Compressed logs and archives are opened according to their names.
+func (a *Application) RunReaders(readers ...NamedReader) error {
+	return a.run(readerItems(readers...))
+}
+
+// readerItems makes log items of readers
+func readerItems(readers ...NamedReader) []interface{} {
+	items := []interface{}{}
+	for _, r := range readers {
+		items = append(items, &readerItem{name: r.Name, r: r.Reader})
+	}
+	return items
+}
+
+// RunFS runs the application on logs of the file system fsys. Patterns are
+// like fs.Glob patterns, folders are explored recursively.
+func (a *Application) RunFS(fsys fs.FS, patterns ...string) error {
+	items, err := fsItems(fsys, patterns...)
+	if err != nil {
+		return err
+	}
+	return a.run(items)
+}
+
+// fsItems makes log items of files of fsys matching patterns
+func fsItems(fsys fs.FS, patterns ...string) ([]interface{}, error) {
+	items := []interface{}{}
+	for _, pattern := range patterns {
+		names, err := fs.Glob(fsys, pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			err = fs.WalkDir(fsys, name, func(p string, d fs.DirEntry, err error) error {
+				if err == nil && !d.IsDir() {
+					items = append(items, &fsItem{fsys: fsys, name: p})
+				}
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return items, nil
+}
+
+// sources gives the inputs of the pipeline: files given on the command line,
+// where "-" is the standard input, and logs given by readers or file systems.
+func (a *Application) sources() []interface{} {
+	sources := []interface{}{}
+	for _, file := range a.files {
+		if file == "-" {
+			// The standard input has no name telling its compression
+			ext, r := sniffCompression(os.Stdin)
+			sources = append(sources, &readerItem{name: "-" + ext, r: r})
+		} else {
+			sources = append(sources, file)
+		}
+	}
+	return append(sources, a.items...)
+}
+
+// compression magic numbers
+var magics = []struct {
+	ext   string
+	magic []byte
+}{
+	{".gz", []byte{0x1f, 0x8b}},
+	{".bz2", []byte("BZh")},
+	{".xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0}},
+	{".zst", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+}
+
+// sniffCompression gives the extension of the compression of r, if any,
+// and a reader on the whole content
+func sniffCompression(r io.Reader) (string, io.Reader) {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(6)
+	for _, m := range magics {
+		if bytes.HasPrefix(head, m.magic) {
+			return m.ext, br
+		}
+	}
+	return "", br
+}
+
+// pathsOperator makes the flow of files found in paths (files, folders, archives,
+// wild cards). Files given as logItem, like the standard input, pass through.
+func pathsOperator() pipeline.Operator {
+	paths := pipeline.NewFlow(
+		// Expands arguments having wild cards into flow of path
+		pipeline.GlobOperator(),
+
+		// Walks through paths and makes a flow of items (folder files, archive items)
+		pipeline.NewParallelFlow(8, walkOperator()),
+	)
+	return func(in, out chan interface{}) {
+		pathIn := make(chan interface{})
+		done := make(chan struct{})
+		go func() {
+			for i := range paths.Run(pathIn) {
+				out <- i
+			}
+			close(done)
+		}()
+		for i := range in {
+			if _, ok := i.(logItem); ok {
+				out <- i
+			} else {
+				pathIn <- i
+			}
+		}
+		close(pathIn)
+		<-done
+	}
+}
+
+// walkOperator makes a walker on each path (file, folder, archive), walks through it
+// and emits its items, with the path they come from
+func walkOperator() pipeline.Operator {
+	return func(in, out chan interface{}) {
+		for i := range in {
+			root, ok := i.(string)
+			if !ok {
+				panic("Expecting string in pipeline.Operator walkOperator")
+			}
+			info, err := os.Stat(root)
+			isDir := err == nil && info.IsDir()
+
+			paths := make(chan interface{}, 1)
+			paths <- root
+			close(paths)
+			walk := pipeline.NewFlow(pipeline.FolderToWalkersOperator(), pipeline.WalkOperator())
+			for item := range walk.Run(paths) {
+				out <- walkerItem{WalkItem: item.(walker.WalkItem), root: root, isDir: isDir}
+			}
+		}
+	}
+}
+
+// readerItem is a log read from a reader
+type readerItem struct {
+	name string
+	r    io.Reader
+}
+
+func (r *readerItem) Name() string                  { return r.name }
+func (r *readerItem) Source() (file, member string) { return r.name, "" }
+func (r *readerItem) Reader() (io.Reader, error)    { return r.r, nil }
+func (r *readerItem) Close() error {
+	if c, ok := r.r.(io.Closer); ok && r.r != os.Stdin {
+		return c.Close()
+	}
+	return nil
+}
+
+// fsItem is a file of a fs.FS
+type fsItem struct {
+	fsys fs.FS
+	name string
+	f    fs.File
+}
+
+func (f *fsItem) Name() string { return path.Base(f.name) }
+
+func (f *fsItem) Source() (file, member string) { return f.name, "" }
+
+func (f *fsItem) Reader() (r io.Reader, err error) {
+	f.f, err = f.fsys.Open(f.name)
+	return f.f, err
+}
+
+func (f *fsItem) Close() error {
+	if f.f != nil {
+		return f.f.Close()
+	}
+	return nil
+}
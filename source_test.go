@@ -0,0 +1,57 @@
+package iislog
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+const sourceLog1 = "#Software: Microsoft Internet Information Services 10.0\r\n" +
+	"#Date: 2017-01-31 09:00:00\r\n" +
+	"#Fields: date time cs-uri-stem sc-status\r\n" +
+	"2017-01-31 09:08:40 /a 200\r\n" +
+	"2017-01-31 09:10:00 /c 500\r\n"
+
+const sourceLog2 = "#Software: Microsoft Internet Information Services 10.0\r\n" +
+	"#Date: 2017-01-31 09:00:00\r\n" +
+	"#Fields: date time cs-uri-stem sc-status\r\n" +
+	"2017-01-31 09:09:00 /b 404\r\n"
+
+func TestRunFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"W3SVC1/u_ex170131.log.gz": {Data: gzipped([]byte(sourceLog1))},
+		"W3SVC2/u_ex170131.log":    {Data: []byte(sourceLog2)},
+		"W3SVC2/readme.txt":        {Data: []byte("not a log")},
+		// Renamed logs are recognized by their content
+		"W3SVC3/site1.txt":        {Data: []byte(strings.Replace(sourceLog2, "09:09:00 /b 404", "09:11:00 /d 200", 1))},
+		"W3SVC3/u_ex170131.log.1": {Data: []byte(strings.Replace(sourceLog2, "09:09:00 /b 404", "09:12:00 /e 200", 1))},
+	}
+	a := NewApplication()
+	a.columns = []string{"cs-uri-stem", "status"}
+	b := bytes.NewBuffer(nil)
+	a.SetOutput(b)
+	if err := a.RunFS(fsys, "W3SVC*"); err != nil {
+		t.Fatal(err)
+	}
+	expected := "cs-uri-stem;status\r\n/a;200.0\r\n/b;404.0\r\n/c;500.0\r\n/d;200.0\r\n/e;200.0\r\n"
+	if b.String() != expected {
+		t.Errorf("Expecting %q, got %q", expected, b.String())
+	}
+}
+
+func TestRunReaders(t *testing.T) {
+	a := NewApplication()
+	a.protocolError = true
+	a.columns = []string{"cs-uri-stem"}
+	a.noHeader = true
+	b := bytes.NewBuffer(nil)
+	a.SetOutput(b)
+	a.RunReaders(
+		NamedReader{Name: "-", Reader: strings.NewReader(sourceLog1)},
+		NamedReader{Name: "server2.log", Reader: strings.NewReader(sourceLog2)},
+	)
+	if b.String() != "/b\r\n/c\r\n" {
+		t.Errorf("Expecting /b and /c, got %q", b.String())
+	}
+}
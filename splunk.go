@@ -0,0 +1,71 @@
+package iislog
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+
+	"github.com/simulot/iislog/iis"
+)
+
+// splunkClient sends records to the HTTP Event Collector of Splunk, as JSON
+// events of the iis sourcetype, at the time of the records
+type splunkClient struct {
+	url   string // Event endpoint
+	token string // HEC token
+	line  *recordLine
+}
+
+func newSplunkClient(server, token string, object func(*iis.LogRecord) ([]string, []interface{})) *splunkClient {
+	return &splunkClient{url: sinkEndpoint(server, "/services/collector/event"), token: token, line: newRecordLine(object)}
+}
+
+// splunkEvent is an event of the HTTP Event Collector
+type splunkEvent struct {
+	Time       float64         `json:"time"` // Seconds since the epoch
+	Host       string          `json:"host,omitempty"`
+	Source     string          `json:"source,omitempty"`
+	SourceType string          `json:"sourcetype"`
+	Event      json.RawMessage `json:"event"`
+}
+
+func (c *splunkClient) request(records []*iis.LogRecord) (*http.Request, error) {
+	body := bytes.NewBuffer(nil)
+	enc := json.NewEncoder(body)
+	enc.SetEscapeHTML(false)
+	for _, r := range records {
+		line, err := c.line.format(r)
+		if err != nil {
+			return nil, err
+		}
+		e := splunkEvent{
+			Time:       float64(r.DateTime.UnixMilli()) / 1000,
+			Host:       r.ComputerName,
+			Source:     r.File,
+			SourceType: "iis",
+			Event:      line,
+		}
+		if e.Host == "" && r.Server != nil {
+			e.Host = r.Server.String()
+		}
+		if r.Member != "" {
+			e.Source += "[" + r.Member + "]"
+		}
+		// Events are concatenated
+		if err = enc.Encode(e); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(http.MethodPost, c.url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Splunk "+c.token)
+	return req, nil
+}
+
+// check has nothing to check: the collector accepts or refuses the whole batch
+func (c *splunkClient) check(resp *http.Response, records []*iis.LogRecord) ([]*iis.LogRecord, []*iis.ParseError) {
+	return nil, nil
+}
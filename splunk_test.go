@@ -0,0 +1,63 @@
+package iislog
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplunk(t *testing.T) {
+	sinkBackoff = time.Millisecond
+	defer func() { sinkBackoff = time.Second }()
+
+	// A collector busy at the first request
+	requests := 0
+	events := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch {
+		case r.Header.Get("Authorization") != "Splunk secret":
+			http.Error(w, `{"text":"Invalid token","code":4}`, http.StatusForbidden)
+			return
+		case requests == 1:
+			http.Error(w, `{"text":"Server is busy","code":9}`, http.StatusServiceUnavailable)
+			return
+		}
+		s := bufio.NewScanner(r.Body)
+		for s.Scan() {
+			events = append(events, s.Text())
+		}
+		w.Write([]byte(`{"text":"Success","code":0}`))
+	}))
+	defer srv.Close()
+
+	log := "#Date: 2017-01-31 09:00:00\r\n" +
+		"#Fields: date time s-ip cs-uri-stem sc-status\r\n" +
+		"2017-01-31 09:08:40 10.0.0.10 /a 200\r\n"
+	ship := func(token string) error {
+		a := NewApplication()
+		a.command = convertCommand
+		a.format = "splunk"
+		a.output = srv.URL + "/"
+		a.token = token
+		a.strict = true
+		return a.RunReaders(NamedReader{Name: "u_ex170131.log", Reader: strings.NewReader(log)})
+	}
+
+	if err := ship("secret"); err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"time":1485853720,"host":"10.0.0.10","source":"u_ex170131.log","sourcetype":"iis","event":{"datetime":"2017-01-31T09:08:40Z","s-ip":"10.0.0.10","cs-uri-stem":"/a","sc-status":200,"status-label":"OK. The client request has succeeded"}}`
+	if requests != 2 || len(events) != 1 || events[0] != expected {
+		t.Errorf("Expecting %s sent again after a busy collector, got %d requests: %q", expected, requests, events)
+	}
+
+	// Refused requests aren't sent again
+	requests = 0
+	if err := ship("wrong"); err == nil || !strings.Contains(err.Error(), "Invalid token") || requests != 1 {
+		t.Errorf("Expecting an invalid token error after 1 request, got %v after %d requests", err, requests)
+	}
+}
@@ -0,0 +1,270 @@
+package iislog
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3" // register sqlite3 driver
+	"github.com/simulot/golib/pipeline"
+	"github.com/simulot/iislog/iis"
+)
+
+// sqlColumn is a column of the records table
+type sqlColumn struct {
+	name, typ string
+	value     func(r *iis.LogRecord) interface{}
+}
+
+// sqlColumns are the columns of the records table: typed fields of records, and their source
+var sqlColumns = []sqlColumn{
+	{"datetime", "TEXT", func(r *iis.LogRecord) interface{} { return r.DateTime.Format("2006-01-02 15:04:05") }},
+	{"sitename", "TEXT", func(r *iis.LogRecord) interface{} { return r.SiteName }},
+	{"computername", "TEXT", func(r *iis.LogRecord) interface{} { return r.ComputerName }},
+	{"server", "TEXT", func(r *iis.LogRecord) interface{} { return sqlIP(r.Server) }},
+	{"port", "INTEGER", func(r *iis.LogRecord) interface{} { return r.Port }},
+	{"ip", "TEXT", func(r *iis.LogRecord) interface{} { return sqlIP(r.Client) }},
+	{"user", "TEXT", func(r *iis.LogRecord) interface{} { return r.User }},
+	{"method", "TEXT", func(r *iis.LogRecord) interface{} { return r.Method }},
+	{"uri", "TEXT", func(r *iis.LogRecord) interface{} { return r.URI }},
+	{"site", "TEXT", func(r *iis.LogRecord) interface{} { return r.Site }},
+	{"query", "TEXT", func(r *iis.LogRecord) interface{} { return r.Query }},
+	{"asp_line", "INTEGER", func(r *iis.LogRecord) interface{} { return r.ASPLine }},
+	{"asp_error_code", "TEXT", func(r *iis.LogRecord) interface{} { return r.ASPErrorCode }},
+	{"asp_error", "TEXT", func(r *iis.LogRecord) interface{} { return r.ASPError }},
+	{"version", "TEXT", func(r *iis.LogRecord) interface{} { return r.Version }},
+	{"host", "TEXT", func(r *iis.LogRecord) interface{} { return r.Host }},
+	{"agent", "TEXT", func(r *iis.LogRecord) interface{} { return r.UserAgent }},
+	{"referer", "TEXT", func(r *iis.LogRecord) interface{} { return r.Referer }},
+	{"cookie", "TEXT", func(r *iis.LogRecord) interface{} { return r.Cookie }},
+	{"status", "INTEGER", func(r *iis.LogRecord) interface{} { return r.Status }},
+	{"substatus", "INTEGER", func(r *iis.LogRecord) interface{} { return r.SubStatus }},
+	{"win32_status", "INTEGER", func(r *iis.LogRecord) interface{} { return r.Win32Status }},
+	{"bytes", "INTEGER", func(r *iis.LogRecord) interface{} { return r.BytesSent }},
+	{"received", "INTEGER", func(r *iis.LogRecord) interface{} { return r.BytesReceived }},
+	{"time_taken", "INTEGER", func(r *iis.LogRecord) interface{} { return r.TimeTaken.Milliseconds() }},
+	{"other", "TEXT", func(r *iis.LogRecord) interface{} {
+		if len(r.Other) == 0 {
+			return nil
+		}
+		b, _ := json.Marshal(r.Other)
+		return string(b)
+	}},
+	{"source_file", "TEXT", func(r *iis.LogRecord) interface{} { return r.File }},
+	{"source_member", "TEXT", func(r *iis.LogRecord) interface{} { return r.Member }},
+	{"source_offset", "INTEGER", func(r *iis.LogRecord) interface{} { return r.Offset }},
+	{"source_line", "INTEGER", func(r *iis.LogRecord) interface{} { return r.Line }},
+}
+
+// sqlIndexes are the indexed columns of the records table
+var sqlIndexes = []string{"datetime", "status", "uri", "user", "ip"}
+
+// sqlBatch is the number of records inserted by transaction
+const sqlBatch = 10000
+
+// sqlIP gives the text of an IP address, NULL when missing
+func sqlIP(ip net.IP) interface{} {
+	if ip == nil {
+		return nil
+	}
+	return ip.String()
+}
+
+// sqlSchema gives the statements creating the records table and its indexes,
+// unless they exist, so records are appended to those of a previous run
+func sqlSchema() []string {
+	cols := []string{}
+	for _, c := range sqlColumns {
+		cols = append(cols, `"`+c.name+`" `+c.typ)
+	}
+	schema := []string{"CREATE TABLE IF NOT EXISTS records (" + strings.Join(cols, ", ") + ")"}
+	for _, c := range sqlIndexes {
+		schema = append(schema, `CREATE INDEX IF NOT EXISTS records_`+c+` ON records ("`+c+`")`)
+	}
+	return schema
+}
+
+// sqlLoader inserts records into the records table
+type sqlLoader struct {
+	db    *sql.DB
+	tx    *sql.Tx
+	stmt  *sql.Stmt
+	count int
+	args  []interface{}
+}
+
+// newSQLLoader creates the records table in db, if needed
+func newSQLLoader(db *sql.DB) (*sqlLoader, error) {
+	for _, s := range sqlSchema() {
+		if _, err := db.Exec(s); err != nil {
+			return nil, err
+		}
+	}
+	return &sqlLoader{db: db, args: make([]interface{}, len(sqlColumns))}, nil
+}
+
+// add inserts a record
+func (l *sqlLoader) add(r *iis.LogRecord) error {
+	if l.tx == nil {
+		var err error
+		if l.tx, err = l.db.Begin(); err != nil {
+			return err
+		}
+		names := []string{}
+		for _, c := range sqlColumns {
+			names = append(names, `"`+c.name+`"`)
+		}
+		l.stmt, err = l.tx.Prepare("INSERT INTO records (" + strings.Join(names, ", ") + ") VALUES (?" + strings.Repeat(", ?", len(sqlColumns)-1) + ")")
+		if err != nil {
+			return err
+		}
+	}
+	for i, c := range sqlColumns {
+		l.args[i] = c.value(r)
+	}
+	if _, err := l.stmt.Exec(l.args...); err != nil {
+		return err
+	}
+	l.count++
+	if l.count%sqlBatch == 0 {
+		return l.commit()
+	}
+	return nil
+}
+
+// commit ends the current transaction
+func (l *sqlLoader) commit() error {
+	if l.tx == nil {
+		return nil
+	}
+	l.stmt.Close()
+	err := l.tx.Commit()
+	l.tx = nil
+	return err
+}
+
+// loadRecords inserts records coming from in into db. After an error, remaining records are discarded.
+func loadRecords(db *sql.DB, in chan interface{}) error {
+	l, err := newSQLLoader(db)
+	for i := range in {
+		r, ok := i.(*iis.LogRecord)
+		if !ok {
+			panic("Expecting *iis.LogRecord in SQLite pipeline.Operator")
+		}
+		if err == nil {
+			err = l.add(r)
+		}
+	}
+	if err == nil {
+		err = l.commit()
+	}
+	return err
+}
+
+// SQLiteOutputOperator creates an output appending records to the SQLite database given by --output
+func (a *Application) SQLiteOutputOperator() pipeline.Operator {
+	return func(in, out chan interface{}) {
+		db, err := sql.Open("sqlite3", a.output)
+		if err != nil {
+			a.errs.add(&iis.ParseError{File: a.output, Err: err})
+			for range in {
+			}
+			return
+		}
+		defer db.Close()
+		if err = loadRecords(db, in); err != nil {
+			a.errs.add(&iis.ParseError{File: a.output, Err: err})
+		}
+	}
+}
+
+// openSQLMemory opens an in-memory database, with the records table
+func openSQLMemory() (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		return nil, err
+	}
+	// Each connection has its own in-memory database
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+// checkSQL checks the syntax of a query on the records table
+func checkSQL(query string) error {
+	db, err := openSQLMemory()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if _, err = newSQLLoader(db); err != nil {
+		return err
+	}
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return err
+	}
+	return stmt.Close()
+}
+
+// SQLOperator creates an operator that loads records into an in-memory SQLite
+// database, and writes the result of the sql command query
+func (a *Application) SQLOperator() pipeline.Operator {
+	return func(in, out chan interface{}) {
+		db, err := openSQLMemory()
+		if err != nil {
+			a.errs.add(&iis.ParseError{File: "sql", Err: err})
+			for range in {
+			}
+			return
+		}
+		defer db.Close()
+		if err = loadRecords(db, in); err == nil {
+			err = a.writeQuery(db)
+		}
+		if err != nil {
+			a.errs.add(&iis.ParseError{File: "sql", Err: err})
+		}
+	}
+}
+
+// writeQuery runs the query of the sql command, and writes its result
+func (a *Application) writeQuery(db *sql.DB) error {
+	// After Ctrl-C, the query runs on records already loaded
+	rows, err := db.Query(a.sqlQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	w := a.newRowWriter(a.out)
+	w.WriteHeader(columns)
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	for rows.Next() {
+		if err = rows.Scan(pointers...); err != nil {
+			return err
+		}
+		for i, v := range values {
+			switch t := v.(type) {
+			case []byte:
+				values[i] = string(t)
+			case nil:
+				values[i] = ""
+			}
+		}
+		if err = w.WriteRow(values); err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	return w.Flush()
+}
@@ -0,0 +1,80 @@
+package iislog
+
+import (
+	"bytes"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSQL(t *testing.T) {
+	a := NewApplication()
+	a.command = sqlCommand
+	a.sqlQuery = "SELECT status, count(*) AS n, group_concat(source_file) AS files FROM records GROUP BY status ORDER BY status"
+	b := bytes.NewBuffer(nil)
+	a.SetOutput(b)
+	err := a.RunReaders(
+		NamedReader{Name: "server1.log", Reader: strings.NewReader(sourceLog1)},
+		NamedReader{Name: "server2.log", Reader: strings.NewReader(sourceLog2)},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "status;n;files\r\n200;1;server1.log\r\n404;1;server2.log\r\n500;1;server1.log\r\n"
+	if b.String() != expected {
+		t.Errorf("Expecting %q, got %q", expected, b.String())
+	}
+
+	if err = checkSQL("SELECT nothing FROM records"); err == nil {
+		t.Error("Expecting an error for an unknown column")
+	}
+}
+
+func TestSQLiteOutput(t *testing.T) {
+	a := NewApplication()
+	a.format = "sqlite"
+	a.output = filepath.Join(t.TempDir(), "logs.db")
+	err := a.RunReaders(
+		NamedReader{Name: "server1.log", Reader: strings.NewReader(sourceLog1)},
+		NamedReader{Name: "server2.log", Reader: strings.NewReader(sourceLog2)},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", a.output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var uri, datetime string
+	var line int
+	err = db.QueryRow("SELECT uri, datetime, source_line FROM records WHERE status = 404").Scan(&uri, &datetime, &line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri != "/b" || datetime != "2017-01-31 09:09:00" || line != 4 {
+		t.Errorf("Expecting /b at 2017-01-31 09:09:00 line 4, got %s at %s line %d", uri, datetime, line)
+	}
+
+	// A second run appends its records
+	var count int
+	if err = db.QueryRow("SELECT count(*) FROM records").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	output := a.output
+	a = NewApplication()
+	a.format = "sqlite"
+	a.output = output
+	if err = a.RunReaders(NamedReader{Name: "server1.log", Reader: strings.NewReader(sourceLog1)}); err != nil {
+		t.Fatal(err)
+	}
+	var appended int
+	if err = db.QueryRow("SELECT count(*) FROM records").Scan(&appended); err != nil {
+		t.Fatal(err)
+	}
+	if count == 0 || appended <= count {
+		t.Errorf("Expecting records appended to the %d records, got %d records", count, appended)
+	}
+}
@@ -0,0 +1,134 @@
+package iislog
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/simulot/golib/pipeline"
+	"github.com/simulot/iislog/iis"
+)
+
+// statGroup accumulates values of records sharing the same group-by values
+type statGroup struct {
+	keys      []interface{} // Group by values
+	count     int
+	timeTaken serie // in milliseconds
+	bytes     serie // sent by the server
+}
+
+// serie is a list of values to be summarized
+type serie []int64
+
+func (s serie) sum() (sum int64) {
+	for _, v := range s {
+		sum += v
+	}
+	return
+}
+
+// nearestRank gives the index of the p percentile in n sorted values, by the
+// nearest-rank method: the smallest value under which p percent of values fall
+func nearestRank(p float64, n int) int {
+	i := int(math.Ceil(p*float64(n)/100)) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= n {
+		i = n - 1
+	}
+	return i
+}
+
+// percentile returns the value under which p percent of values fall.
+// The serie must be sorted.
+func (s serie) percentile(p float64) int64 {
+	if len(s) == 0 {
+		return 0
+	}
+	return s[nearestRank(p, len(s))]
+}
+
+// summary returns sum, avg, min, max, p50, p95 and p99 of the serie
+func (s serie) summary() []interface{} {
+	if len(s) == 0 {
+		return []interface{}{0, 0, 0, 0, 0, 0, 0}
+	}
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	sum := s.sum()
+	return []interface{}{sum, sum / int64(len(s)), s[0], s[len(s)-1], s.percentile(50), s.percentile(95), s.percentile(99)}
+}
+
+var summaryColumns = []string{"sum", "avg", "min", "max", "p50", "p95", "p99"}
+
+// statsHeader gives column names of the statistics report
+func (a *Application) statsHeader() []string {
+	h := append([]string{}, a.groupBy...)
+	h = append(h, "count")
+	for _, c := range summaryColumns {
+		h = append(h, "time-taken-"+c+"(ms)")
+	}
+	for _, c := range summaryColumns {
+		h = append(h, "sc-bytes-"+c)
+	}
+	return h
+}
+
+// StatsOperator creates an operator that groups records by the --group-by fields
+// and reports count, time taken and bytes statistics for each group
+func (a *Application) StatsOperator() pipeline.Operator {
+	fields := make([]string, len(a.groupBy))
+	for i, f := range a.groupBy {
+		fields[i] = columnField(f)
+	}
+
+	return func(in, out chan interface{}) {
+		groups := map[string]*statGroup{}
+		for i := range in {
+			if item, ok := i.(*iis.LogRecord); ok {
+				keys := make([]interface{}, len(fields))
+				id := make([]string, len(fields))
+				for j, f := range fields {
+					keys[j] = a.fieldValue(item, f)
+					id[j] = fmt.Sprint(keys[j])
+				}
+				key := strings.Join(id, "\x00")
+				g, ok := groups[key]
+				if !ok {
+					g = &statGroup{keys: keys}
+					groups[key] = g
+				}
+				g.count++
+				g.timeTaken = append(g.timeTaken, int64(item.TimeTaken/time.Millisecond))
+				g.bytes = append(g.bytes, item.BytesSent)
+			} else {
+				panic("Expecting *iis.LogRecord in pipeline.Operator StatsOperator")
+			}
+		}
+
+		// Biggest groups first
+		list := make([]*statGroup, 0, len(groups))
+		for _, g := range groups {
+			list = append(list, g)
+		}
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].count != list[j].count {
+				return list[i].count > list[j].count
+			}
+			return fmt.Sprint(list[i].keys...) < fmt.Sprint(list[j].keys...)
+		})
+
+		w := a.newRowWriter(a.out)
+		w.WriteHeader(a.statsHeader())
+		for _, g := range list {
+			row := append([]interface{}{}, g.keys...)
+			row = append(row, g.count)
+			row = append(row, g.timeTaken.summary()...)
+			row = append(row, g.bytes.summary()...)
+			w.WriteRow(row)
+		}
+		w.Flush()
+	}
+}
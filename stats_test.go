@@ -0,0 +1,68 @@
+package iislog
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSerieSummary(t *testing.T) {
+	tests := []struct {
+		serie    serie
+		expected string // sum, avg, min, max, p50, p95, p99
+	}{
+		{serie{}, "[0 0 0 0 0 0 0]"},
+		{serie{7}, "[7 7 7 7 7 7 7]"},
+		{serie{30, 10, 20}, "[60 20 10 30 20 30 30]"},
+		{serie{10, 9, 8, 7, 6, 5, 4, 3, 2, 1}, "[55 5 1 10 5 10 10]"},
+		// Nearest rank: p95 of 20 values is the 19th, p99 the 20th
+		{serie{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}, "[210 10 1 20 10 19 20]"},
+		// p95 of 11 and 13 values is the largest one
+		{serie{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}, "[66 6 1 11 6 11 11]"},
+		{serie{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13}, "[91 7 1 13 7 13 13]"},
+		// Average is truncated
+		{serie{1, 2}, "[3 1 1 2 1 2 2]"},
+	}
+	for _, tt := range tests {
+		if got := fmt.Sprint(tt.serie.summary()); got != tt.expected {
+			t.Errorf("%v: expecting %s, got %s", tt.serie, tt.expected, got)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	log := "#Date: 2017-01-31 09:00:00\r\n" +
+		"#Fields: date time cs-uri-stem sc-status sc-bytes time-taken\r\n" +
+		"2017-01-31 09:00:01 /a 200 100 10\r\n" +
+		"2017-01-31 09:00:02 /b 500 50 1000\r\n" +
+		"2017-01-31 09:00:03 /a 200 300 30\r\n" +
+		"2017-01-31 09:00:04 /a 404 200 20\r\n" +
+		"2017-01-31 09:00:05 /b 500 150 3000\r\n"
+
+	tests := []struct {
+		groupBy  []string
+		expected string
+	}{
+		{nil, "5;4060;812;10;3000;30;3000;3000;800;160;50;300;150;300;300"},
+		{[]string{"uri"}, "/a;3;60;20;10;30;20;30;30;600;200;100;300;200;300;300\r\n" +
+			"/b;2;4000;2000;1000;3000;1000;3000;3000;200;100;50;150;50;150;150"},
+		{[]string{"uri", "sc-status"}, "/a;200;2;40;20;10;30;10;30;30;400;200;100;300;100;300;300\r\n" +
+			"/b;500;2;4000;2000;1000;3000;1000;3000;3000;200;100;50;150;50;150;150\r\n" +
+			"/a;404;1;20;20;20;20;20;20;20;200;200;200;200;200;200;200"},
+	}
+	for _, tt := range tests {
+		a := NewApplication()
+		a.command = statsCommand
+		a.groupBy = tt.groupBy
+		a.noHeader = true
+		b := bytes.NewBuffer(nil)
+		a.SetOutput(b)
+		if err := a.RunReaders(NamedReader{Name: "u_ex170131.log", Reader: strings.NewReader(log)}); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSuffix(b.String(), "\r\n"); got != tt.expected {
+			t.Errorf("%v: expecting\n%s\ngot\n%s", tt.groupBy, tt.expected, got)
+		}
+	}
+}
@@ -0,0 +1,360 @@
+package iislog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/simulot/golib/pipeline"
+	"github.com/simulot/iislog/iis"
+)
+
+// A store keeps log records in a compact columnar format, faster to search than
+// text logs. It's made of blocks of records, each one starting with statistics like
+// those of index blocks, so blocks that can't match are skipped without being
+// decompressed. In a block, values of each field are dictionary-encoded, times are
+// delta-encoded, and the whole is compressed with zstd.
+
+// storeExt is the extension of store files
+const storeExt = ".iisstore"
+
+// storeMagic starts store files
+var storeMagic = []byte("IISLOGSTORE1\n")
+
+// storeBlockLines is the number of records of a store block
+const storeBlockLines = 8192
+
+// storeColumns are the records of a store block
+type storeColumns struct {
+	Start   int64                  // Unix time of the first record
+	Times   []int64                // Time of each record, in seconds after the previous one
+	Layouts [][]string             // Lists of fields of records
+	Layout  []int                  // List of fields of each record
+	Columns map[string]*dictColumn // Values of each field, but date and time given by Times
+	Files   dictColumn             // Source file of each record
+	Members dictColumn             // Source archive member of each record
+	Lines   []int                  // Source line of each record
+	Offsets []int64                // Source offset of each record
+
+	count   int            // Count of records
+	last    int64          // Time of the last record
+	layouts map[string]int // Layouts by fields
+}
+
+// dictColumn is a dictionary-encoded column of strings. The value 0 is the empty string.
+type dictColumn struct {
+	Dict   []string
+	Values []uint32
+
+	index map[string]uint32
+}
+
+// set sets the value of the record row
+func (c *dictColumn) set(row int, value string) {
+	if c.index == nil {
+		c.Dict = []string{""}
+		c.index = map[string]uint32{"": 0}
+	}
+	v, ok := c.index[value]
+	if !ok {
+		v = uint32(len(c.Dict))
+		c.Dict = append(c.Dict, value)
+		c.index[value] = v
+	}
+	c.pad(row)
+	c.Values = append(c.Values, v)
+}
+
+// pad gives the empty value to records missing before row
+func (c *dictColumn) pad(row int) {
+	for len(c.Values) < row {
+		c.Values = append(c.Values, 0)
+	}
+}
+
+func (c *dictColumn) get(row int) string {
+	if row >= len(c.Values) {
+		return ""
+	}
+	return c.Dict[c.Values[row]]
+}
+
+// timedLayout returns true when date and time fields of records are given by Times
+func timedLayout(fields []string) bool {
+	date, time := false, false
+	for _, f := range fields {
+		date = date || f == "date"
+		time = time || f == "time"
+	}
+	return date && time
+}
+
+// add appends a record to the block
+func (c *storeColumns) add(r *iis.LogRecord) {
+	t := r.DateTime.Unix()
+	if c.count == 0 {
+		c.Start, c.last = t, t
+		c.Columns = map[string]*dictColumn{}
+		c.layouts = map[string]int{}
+	}
+	c.Times = append(c.Times, t-c.last)
+	c.last = t
+
+	key := strings.Join(r.Fields, " ")
+	l, ok := c.layouts[key]
+	if !ok {
+		l = len(c.Layouts)
+		c.Layouts = append(c.Layouts, r.Fields)
+		c.layouts[key] = l
+	}
+	c.Layout = append(c.Layout, l)
+
+	timed := timedLayout(r.Fields)
+	for i, value := range strings.Split(r.Raw, " ") {
+		if i >= len(r.Fields) {
+			break
+		}
+		f := r.Fields[i]
+		if timed && (f == "date" || f == "time") {
+			continue
+		}
+		col, ok := c.Columns[f]
+		if !ok {
+			col = &dictColumn{}
+			c.Columns[f] = col
+		}
+		col.set(c.count, value)
+	}
+	c.Files.set(c.count, r.File)
+	c.Members.set(c.count, r.Member)
+	c.Lines = append(c.Lines, r.Line)
+	c.Offsets = append(c.Offsets, r.Offset)
+	c.count++
+}
+
+// storeWriter writes records into a store
+type storeWriter struct {
+	w       *bufio.Writer
+	enc     *zstd.Encoder
+	block   *blockBuilder
+	columns *storeColumns
+}
+
+func newStoreWriter(w io.Writer) (*storeWriter, error) {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	s := &storeWriter{w: bufio.NewWriter(w), enc: enc}
+	_, err = s.w.Write(storeMagic)
+	return s, err
+}
+
+// Write adds a record to the store
+func (s *storeWriter) Write(r *iis.LogRecord) error {
+	if s.block == nil {
+		s.block = newBlockBuilder(iis.Position{})
+		s.columns = &storeColumns{}
+	}
+	s.block.add(r)
+	s.columns.add(r)
+	if s.columns.count == storeBlockLines {
+		return s.flushBlock()
+	}
+	return nil
+}
+
+// flushBlock writes the current block: the length of its statistics, its statistics,
+// then its compressed records, which size is given by statistics
+func (s *storeWriter) flushBlock() error {
+	if s.block == nil {
+		return nil
+	}
+	c := s.columns
+	for _, col := range c.Columns {
+		col.pad(c.count)
+	}
+	b := bytes.NewBuffer(nil)
+	if err := gob.NewEncoder(b).Encode(c); err != nil {
+		return err
+	}
+	records := s.enc.EncodeAll(b.Bytes(), nil)
+
+	stats := s.block.close(nil)
+	stats.Size = int64(len(records))
+	b.Reset()
+	if err := gob.NewEncoder(b).Encode(stats); err != nil {
+		return err
+	}
+	s.w.Write(binary.AppendUvarint(nil, uint64(b.Len())))
+	s.w.Write(b.Bytes())
+	_, err := s.w.Write(records)
+	s.block, s.columns = nil, nil
+	return err
+}
+
+// Close writes the last block
+func (s *storeWriter) Close() error {
+	err := s.flushBlock()
+	if err == nil {
+		err = s.w.Flush()
+	}
+	s.enc.Close()
+	return err
+}
+
+// StoreOutputOperator creates an output writing records into the store given by --output,
+// or into the output of the application
+func (a *Application) StoreOutputOperator() pipeline.Operator {
+	return func(in, out chan interface{}) {
+		var (
+			w   *storeWriter
+			err error
+			dst = a.out
+		)
+		if a.output != "" {
+			var f *os.File
+			if f, err = os.Create(a.output); err == nil {
+				defer f.Close()
+				dst = f
+			}
+		}
+		if err == nil {
+			w, err = newStoreWriter(dst)
+		}
+		for i := range in {
+			item, ok := i.(*iis.LogRecord)
+			if !ok {
+				panic("Expecting *iis.LogRecord in pipeline.Operator StoreOutputOperator")
+			}
+			if err == nil {
+				err = w.Write(item)
+			}
+		}
+		if err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			a.errs.add(&iis.ParseError{File: a.output, Err: err})
+		}
+	}
+}
+
+// errNotStore is reported when a store file doesn't start with storeMagic
+var errNotStore = errors.New("not an iislog store")
+
+// storeRecords reads the records of a store, skipping blocks that can't match
+func (s *recordStream) storeRecords(r io.Reader) chan *iis.LogRecord {
+	out := make(chan *iis.LogRecord)
+	go func() {
+		defer close(out)
+		dec, err := zstd.NewReader(nil)
+		if err != nil {
+			s.errs.report(s.file.item, err)
+			return
+		}
+		defer dec.Close()
+
+		br := bufio.NewReader(r)
+		magic := make([]byte, len(storeMagic))
+		if _, err = io.ReadFull(br, magic); err != nil || !bytes.Equal(magic, storeMagic) {
+			s.errs.report(s.file.item, errNotStore)
+			return
+		}
+		for s.ctx.Err() == nil {
+			size, err := binary.ReadUvarint(br)
+			if err == io.EOF {
+				return
+			}
+			stats := &blockIndex{}
+			if err == nil {
+				err = gob.NewDecoder(io.LimitReader(br, int64(size))).Decode(stats)
+			}
+			if err != nil {
+				s.errs.report(s.file.item, fmt.Errorf("store block: %w", err))
+				return
+			}
+			if s.mayMatch != nil && !s.mayMatch(stats) {
+				if _, err = br.Discard(int(stats.Size)); err != nil {
+					s.errs.report(s.file.item, fmt.Errorf("store block: %w", err))
+					return
+				}
+				continue
+			}
+			records := make([]byte, stats.Size)
+			if _, err = io.ReadFull(br, records); err == nil {
+				records, err = dec.DecodeAll(records, nil)
+			}
+			c := &storeColumns{}
+			if err == nil {
+				err = gob.NewDecoder(bytes.NewReader(records)).Decode(c)
+			}
+			if err != nil {
+				s.errs.report(s.file.item, fmt.Errorf("store block: %w", err))
+				return
+			}
+			if !s.sendColumns(c, out) {
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// sendColumns emits the records of a store block matching the filter. It returns
+// false when the context is done.
+func (s *recordStream) sendColumns(c *storeColumns, out chan *iis.LogRecord) bool {
+	checker, _ := s.filter.(iis.RecordChecker)
+	t := c.Start
+	for row := range c.Times {
+		t += c.Times[row]
+		dt := time.Unix(t, 0).UTC()
+		if !s.filter.CheckDate(dt) {
+			continue
+		}
+		fields := c.Layouts[c.Layout[row]]
+		timed := timedLayout(fields)
+		values := make([]string, len(fields))
+		for i, f := range fields {
+			switch {
+			case timed && f == "date":
+				values[i] = dt.Format("2006-01-02")
+			case timed && f == "time":
+				values[i] = dt.Format("15:04:05")
+			case c.Columns[f] != nil:
+				values[i] = c.Columns[f].get(row)
+			}
+		}
+
+		r := iis.NewLogRecord(strings.Join(values, " "), s.filter)
+		r.Fields = fields
+		r.File, r.Member, r.Line, r.Offset = c.Files.get(row), c.Members.get(row), c.Lines[row], c.Offsets[row]
+		selected := true
+		for i, f := range fields {
+			if !r.Set(f, values[i]) {
+				selected = false
+				break
+			}
+		}
+		if selected && checker != nil {
+			selected = checker.CheckRecord(r)
+		}
+		if !selected {
+			continue
+		}
+		select {
+		case out <- r:
+		case <-s.ctx.Done():
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,51 @@
+package iislog
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/simulot/iislog/expr"
+)
+
+func TestStore(t *testing.T) {
+	// Converts two logs into a store
+	a := NewApplication()
+	a.command = convertCommand
+	a.format = "store"
+	store := bytes.NewBuffer(nil)
+	a.SetOutput(store)
+	err := a.RunReaders(
+		NamedReader{Name: "server1.log", Reader: strings.NewReader(sourceLog1)},
+		NamedReader{Name: "server2.log", Reader: strings.NewReader(sourceLog2)},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	search := func(where string) string {
+		a := NewApplication()
+		a.where, _ = expr.Compile(where)
+		a.columns = []string{"cs-uri-stem", "status", "source-file", "source-line"}
+		a.noHeader = true
+		b := bytes.NewBuffer(nil)
+		a.SetOutput(b)
+		if err := a.RunFS(fstest.MapFS{"logs.iisstore": {Data: store.Bytes()}}, "logs.iisstore"); err != nil {
+			t.Fatal(err)
+		}
+		return b.String()
+	}
+
+	expected := "/a;200.0;server1.log;4\r\n/b;404.0;server2.log;4\r\n/c;500.0;server1.log;5\r\n"
+	if got := search(""); got != expected {
+		t.Errorf("Expecting %q, got %q", expected, got)
+	}
+	expected = "/c;500.0;server1.log;5\r\n"
+	if got := search("status >= 500"); got != expected {
+		t.Errorf("Expecting %q, got %q", expected, got)
+	}
+	if got := search("status == 302"); got != "" {
+		t.Errorf("Expecting no record, got %q", got)
+	}
+}
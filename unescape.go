@@ -1,6 +1,9 @@
 package iislog
 
-func unescape(s string) (ret string) {
+// unescape decodes %xx sequences of URLs and queries.
+// Malformed sequences are dropped.
+func unescape(s string) string {
+	ret := make([]byte, 0, len(s))
 	inEscape := 0
 	escapedChar := byte(0)
 	for i := 0; i < len(s); i++ {
@@ -38,13 +41,9 @@ func unescape(s string) (ret string) {
 			}
 		}
 
-		switch next {
-		case 0:
-		case '"':
-			ret += `""`
-		default:
-			ret += string(next)
+		if next != 0 {
+			ret = append(ret, next)
 		}
 	}
-	return
+	return string(ret)
 }
@@ -10,6 +10,8 @@ func TestUnescape(t *testing.T) {
 		{"Abc%3E%3A(%3b%2c)%3Def", "Abc>:(;,)=ef"},
 		{"", ""},
 		{"%41%2YTest", "AYTest"},
+		{"caf%C3%A9", "café"},
+		{`a%22b"c`, `a"b"c`},
 	}
 
 	for _, c := range test {
@@ -0,0 +1,46 @@
+package iislog
+
+import (
+	"bufio"
+	"strings"
+
+	"github.com/simulot/golib/pipeline"
+	"github.com/simulot/iislog/iis"
+)
+
+// W3COutputOperator creates an output writing records as a W3C log file.
+// Directives are written again each time the fields change.
+func (a *Application) W3COutputOperator() pipeline.Operator {
+	return func(in, out chan interface{}) {
+		w := bufio.NewWriter(a.out)
+		var fields []string
+		for i := range in {
+			item, ok := i.(*iis.LogRecord)
+			if !ok {
+				panic("Expecting *iis.LogRecord in pipeline.Operator W3COutputOperator")
+			}
+			if !sameFields(fields, item.Fields) {
+				fields = item.Fields
+				w.WriteString("#Software: iislog\r\n")
+				w.WriteString("#Version: 1.0\r\n")
+				w.WriteString("#Date: " + item.DateTime.Format("2006-01-02 15:04:05") + "\r\n")
+				w.WriteString("#Fields: " + strings.Join(fields, " ") + "\r\n")
+			}
+			w.WriteString(item.Raw)
+			w.WriteString("\r\n")
+		}
+		w.Flush()
+	}
+}
+
+func sameFields(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}